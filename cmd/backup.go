@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+	"github.com/auula/vasedb/server"
+	"github.com/auula/vasedb/vfs"
+)
+
+// runBackup 导出一致性快照到 tar 文件，默认从运行中的服务器在线备份，
+// 指定 --path 时直接读取已经停止的数据目录
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	host := fs.String("host", server.LocalIPv4(), "--host the HTTP server address.")
+	port := fs.Int("port", conf.Default.Port, "--port the HTTP server port.")
+	auth := fs.String("auth", "", "--auth the server authentication password.")
+	path := fs.String("path", "", "--path back up a stopped data directory instead of a running server.")
+	config := fs.String("config", "", "--config the configuration file path, used with --path.")
+	output := fs.String("output", "vasedb-"+time.Now().Format("20060102150405")+".tar", "--output the backup file path.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	export := func(w io.Writer) error {
+		return fetchBackup(net.JoinHostPort(*host, strconv.Itoa(*port)), *auth, w)
+	}
+	if *path != "" {
+		if err := loadSettings(*config); err != nil {
+			return err
+		}
+		export = func(w io.Writer) error {
+			return exportBackup(*path, w)
+		}
+	}
+
+	if err := writeFileAtomic(*output, export); err != nil {
+		return err
+	}
+
+	clog.Infof("Backup saved to %s", *output)
+
+	return nil
+}
+
+// fetchBackup 从运行中的服务器下载快照
+func fetchBackup(addr, auth string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/backup", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Auth", auth)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request backup: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body server.ResponseBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Message == "" {
+			return fmt.Errorf("server responded %s", resp.Status)
+		}
+		return fmt.Errorf("server responded %s: %s", resp.Status, body.Message)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// exportBackup 只读导出停止运行的数据目录，不会打开数据目录，数据文件和索引快照保持不变
+func exportBackup(path string, w io.Writer) error {
+	_, err := vfs.ExportDir(path, vfs.NewOptions(conf.Settings), w)
+	return err
+}
+
+// writeFileAtomic 先写入临时文件，完整写入并持久化之后再重命名，失败时不会留下不完整的文件
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, conf.FsPerm)
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/auula/vasedb/conf"
+	"github.com/auula/vasedb/vfs"
+)
+
+// runCheck 离线校验数据目录，指定 --repair 时保留校验通过的记录重写损坏的数据文件，
+// 例如 vasedb check --path /data/vasedb --repair
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := fs.String("path", "", "--path the data directory to check, the server must be stopped.")
+	repair := fs.Bool("repair", false, "--repair salvage the valid records of damaged regions.")
+	asJSON := fs.Bool("json", false, "--json print the report as JSON.")
+	config := fs.String("config", "", "--config the configuration file path.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return errors.New("--path is required")
+	}
+	if err := loadSettings(*config); err != nil {
+		return err
+	}
+
+	check := vfs.Check
+	if *repair {
+		check = vfs.Repair
+	}
+
+	report, err := check(*path, vfs.NewOptions(conf.Settings))
+	if report != nil {
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(report)
+		} else {
+			printReport(report)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !*repair && !report.Healthy() {
+		return errors.New("data directory has problems, run with --repair to salvage the valid records")
+	}
+
+	return nil
+}
+
+func printReport(report *vfs.CheckReport) {
+	fmt.Printf("Data directory %s\n", report.Path)
+
+	for _, region := range report.Regions {
+		switch {
+		case region.Error != "":
+			fmt.Printf("  region %04d  %d bytes  unreadable: %s\n", region.ID, region.Size, region.Error)
+		case len(region.Corrupted) > 0:
+			fmt.Printf("  region %04d  format %s  %d bytes  %d records  %d corrupted bytes\n",
+				region.ID, region.Format, region.Size, region.Records, region.CorruptedBytes())
+			for _, c := range region.Corrupted {
+				fmt.Printf("    [%d, %d) %s\n", c.Start, c.End, c.Reason)
+			}
+		default:
+			fmt.Printf("  region %04d  format %s  %d bytes  %d records  ok\n", region.ID, region.Format, region.Size, region.Records)
+		}
+	}
+
+	if report.Snapshot != "" {
+		fmt.Printf("  index snapshot is invalid: %s\n", report.Snapshot)
+	}
+	if len(report.Dangling) > 0 {
+		fmt.Printf("  %d index snapshot entries point to missing or corrupted records:\n", len(report.Dangling))
+		for _, key := range report.Dangling {
+			fmt.Printf("    %q\n", key)
+		}
+	}
+	if len(report.Lost) > 0 {
+		fmt.Printf("  %d keys lost their latest record, repair deletes them:\n", len(report.Lost))
+		for _, key := range report.Lost {
+			fmt.Printf("    %q\n", key)
+		}
+	}
+	for _, name := range report.Orphans {
+		fmt.Printf("  orphaned file %s\n", name)
+	}
+	for _, name := range report.Quarantined {
+		fmt.Printf("  quarantined region %s\n", name)
+	}
+	for _, id := range report.Repaired {
+		fmt.Printf("  repaired region %04d\n", id)
+	}
+
+	if report.Healthy() {
+		fmt.Println("No problem found")
+	}
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+// command 是 vasedb 的运维子命令，例如 vasedb backup --output backup.tar，
+// 子命令有自己的参数，不会启动 HTTP 服务器
+type command func(args []string) error
+
+var commands = map[string]command{
+	"backup":  runBackup,  // vasedb backup [--host HOST --port PORT --auth PASSWORD | --path DIR] [--output FILE]
+	"restore": runRestore, // vasedb restore --from BACKUP --path DIR [--logs DIR] [--until TIME | --seq N]
+	"check":   runCheck,   // vasedb check --path DIR [--repair] [--json]
+	"upgrade": runUpgrade, // vasedb upgrade --path DIR
+}
+
+// subcommand 返回命令行中的子命令，没有子命令时启动服务器
+func subcommand() (string, command, bool) {
+	if len(os.Args) < 2 {
+		return "", nil, false
+	}
+	c, ok := commands[os.Args[1]]
+	return os.Args[1], c, ok
+}
+
+func runCommand(name string, c command) {
+	err := c(os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		clog.Errorf("%s failed: %v", name, err)
+		os.Exit(1)
+	}
+}
+
+// loadSettings 加载子命令使用的配置文件，例如加密密钥
+func loadSettings(path string) error {
+	if !conf.HasCustom(path) {
+		return nil
+	}
+	if err := conf.Load(path, conf.Settings); err != nil {
+		return fmt.Errorf("failed to load config file: %w", err)
+	}
+	return nil
+}
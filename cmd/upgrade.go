@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+	"github.com/auula/vasedb/vfs"
+)
+
+// runUpgrade 离线将数据目录中旧格式的数据文件重写为当前格式，
+// 例如 vasedb upgrade --path /data/vasedb
+func runUpgrade(args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	path := fs.String("path", "", "--path the data directory to upgrade, the server must be stopped.")
+	config := fs.String("config", "", "--config the configuration file path.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return errors.New("--path is required")
+	}
+	if err := loadSettings(*config); err != nil {
+		return err
+	}
+
+	stat, err := vfs.Upgrade(*path, vfs.NewOptions(conf.Settings))
+	if err != nil {
+		return err
+	}
+
+	clog.Infof("Upgrade finished, %d regions rewritten in format %s", stat.Regions, stat.Format)
+
+	return nil
+}
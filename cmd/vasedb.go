@@ -46,6 +46,11 @@ var (
 // 初始化全局需要使用的组件
 // 解析命令行输入的参数，默认命令行参数优先级最高，但是相对于能设置参数比较少
 func init() {
+	// 子命令使用自己的参数，不需要初始化服务器
+	if _, _, ok := subcommand(); ok {
+		return
+	}
+
 	fmt.Println(banner)
 	fl := parseFlags()
 
@@ -96,6 +101,11 @@ func init() {
 }
 
 func StartApp() {
+	if name, c, ok := subcommand(); ok {
+		runCommand(name, c)
+		return
+	}
+
 	if daemon {
 		runAsDaemon()
 	} else {
@@ -125,7 +135,7 @@ func runServer() {
 		clog.Failed(err)
 	}
 
-	fss, err := vfs.OpenFS(conf.Settings.Path)
+	fss, err := openStorage()
 	if err != nil {
 		clog.Failed(err)
 	} else {
@@ -146,6 +156,15 @@ func runServer() {
 	select {}
 }
 
+// openStorage 根据配置打开磁盘存储或者纯内存存储
+func openStorage() (vfs.Storage, error) {
+	if conf.Settings.Memory.Enable {
+		clog.Info("Running in memory storage mode, data will be lost after exit")
+		return vfs.NewMemoryStorage(vfs.NewMemoryOptions(conf.Settings))
+	}
+	return vfs.OpenFS(conf.Settings.Path, vfs.NewOptions(conf.Settings))
+}
+
 type flags struct {
 	auth   string
 	port   int
@@ -3,9 +3,13 @@ package conf
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
@@ -17,17 +21,46 @@ const (
 	defaultFilePath = ""
 	// 设置默认文件系统权限
 	FsPerm = fs.FileMode(0755)
+	// MaxRegion is the largest region size in KB, record offsets within a region are 32-bit
+	MaxRegion = math.MaxUint32 / 1024
 	// DefaultConfigJSON configure json string
 	DefaultConfigJSON = `
 {
 	"port": 2468,
 	"path": "/tmp/vasedb",
+	"mode": "pread",
+	"region": 102400,
+	"sync": "always",
 	"auth": "",
 	"log_path": "/tmp/vasedb/out.log",
 	"debug": false,
 	"compressor": {
 		"enable": true,
-		"second": 15000
+		"second": 15000,
+		"threshold": 0.5
+	},
+	"index": {
+		"shards": 0,
+		"adaptive": false
+	},
+	"compression": {
+		"codec": "none",
+		"min_size": 256
+	},
+	"scrubber": {
+		"enable": true,
+		"second": 86400,
+		"rate": 4096
+	},
+	"encryption": {
+		"enable": false,
+		"key_file": "",
+		"key_env": "VASEDB_ENCRYPTION_KEY"
+	},
+	"memory": {
+		"enable": false,
+		"max_memory": 0,
+		"eviction": "lru"
 	}
 }
 `
@@ -52,19 +85,133 @@ func HasCustom(path string) bool {
 	return path != defaultFilePath
 }
 
+const (
+	// ModePread reads region files with pread system calls
+	ModePread = "pread"
+	// ModeMmap reads region files through memory mappings
+	ModeMmap = "mmap"
+	// ModeDirect writes the active region with O_DIRECT
+	ModeDirect = "direct"
+)
+
+// ValidMode reports whether mode is a supported read mode, empty means ModePread.
+func ValidMode(mode string) bool {
+	switch mode {
+	case "", ModePread, ModeMmap, ModeDirect:
+		return true
+	}
+	return false
+}
+
+const (
+	// EvictLRU evicts the least recently used segments
+	EvictLRU = "lru"
+	// EvictLFU evicts the least frequently used segments
+	EvictLFU = "lfu"
+)
+
+// ValidEviction reports whether policy is a supported eviction policy, empty means EvictLRU.
+func ValidEviction(policy string) bool {
+	switch policy {
+	case "", EvictLRU, EvictLFU:
+		return true
+	}
+	return false
+}
+
+const (
+	// CodecNone stores record values uncompressed
+	CodecNone = "none"
+	// CodecSnappy compresses record values with snappy
+	CodecSnappy = "snappy"
+	// CodecZstd compresses record values with zstd
+	CodecZstd = "zstd"
+)
+
+// ValidCodec reports whether codec is a supported compression codec, empty means CodecNone.
+func ValidCodec(codec string) bool {
+	switch codec {
+	case "", CodecNone, CodecSnappy, CodecZstd:
+		return true
+	}
+	return false
+}
+
+// SyncMode is the durability policy of appended records.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs before a write is acknowledged
+	SyncAlways SyncMode = iota
+	// SyncEvery fsyncs periodically in the background
+	SyncEvery
+	// SyncOS leaves flushing to the operating system
+	SyncOS
+)
+
+// ParseSync parses the sync setting: "always", "os" or "every <duration>" like "every 100ms".
+// An empty setting falls back to "always".
+func ParseSync(value string) (SyncMode, time.Duration, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	switch value {
+	case "", "always":
+		return SyncAlways, 0, nil
+	case "os":
+		return SyncOS, 0, nil
+	}
+
+	interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(value, "every")))
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("invalid sync policy %q, want always, os or every <duration>", value)
+	}
+
+	return SyncEvery, interval, nil
+}
+
 func Vaildated(opt *ServerConfig) error {
 	if opt.Password == "" {
 		return errors.New("auth password is empty")
 	}
-	if opt.Path == "" {
+	// 内存存储模式不需要数据目录
+	if opt.Path == "" && !opt.Memory.Enable {
 		return errors.New("data directory path is empty")
 	}
+	if opt.Region < 0 || opt.Region > MaxRegion {
+		return fmt.Errorf("region size must be between 0 and %d KB", MaxRegion)
+	}
+	if opt.Memory.MaxMemory < 0 {
+		return errors.New("max memory is negative")
+	}
+	if !ValidEviction(opt.Memory.Eviction) {
+		return fmt.Errorf("unsupported eviction policy %q", opt.Memory.Eviction)
+	}
 	if !(opt.Port > 1024 && opt.Port < 65535) {
 		return errors.New("port range not legal")
 	}
 	if opt.LogPath == "" {
 		return errors.New("logging output path is empty")
 	}
+	if !ValidMode(opt.Mode) {
+		return fmt.Errorf("unsupported read mode %q", opt.Mode)
+	}
+	if _, _, err := ParseSync(opt.Sync); err != nil {
+		return err
+	}
+	if !ValidCodec(opt.Compression.Codec) {
+		return fmt.Errorf("unsupported compression codec %q", opt.Compression.Codec)
+	}
+	if opt.Compression.MinSize < 0 {
+		return errors.New("compression min size is negative")
+	}
+	if opt.Encryption.Enable && opt.Encryption.KeyFile == "" && opt.Encryption.KeyEnv == "" {
+		return errors.New("encryption requires a key file or a key environment variable")
+	}
+	if opt.Scrubber.Second < 0 || opt.Scrubber.Rate < 0 {
+		return errors.New("scrubber interval and rate must not be negative")
+	}
+	if opt.Index.Shards < 0 || opt.Index.Shards&(opt.Index.Shards-1) != 0 {
+		return fmt.Errorf("index shards %d is not a power of two", opt.Index.Shards)
+	}
 	return nil
 }
 
@@ -118,15 +265,58 @@ func toString(opt *ServerConfig) string {
 }
 
 type ServerConfig struct {
-	Port       int        `json:"port"`
-	Path       string     `json:"path"`
-	Debug      bool       `json:"debug"`
-	LogPath    string     `json:"log_path"`
-	Password   string     `json:"auth"`
-	Compressor Compressor `json:"compressor"`
+	Port        int         `json:"port"`
+	Path        string      `json:"path"`
+	Mode        string      `json:"mode"`
+	Region      int64       `json:"region"`
+	Sync        string      `json:"sync"`
+	Debug       bool        `json:"debug"`
+	LogPath     string      `json:"log_path"`
+	Password    string      `json:"auth"`
+	Compressor  Compressor  `json:"compressor"`
+	Memory      Memory      `json:"memory"`
+	Index       Index       `json:"index"`
+	Compression Compression `json:"compression"`
+	Encryption  Encryption  `json:"encryption"`
+	Scrubber    Scrubber    `json:"scrubber"`
 }
 
-type Compressor struct {
+// Scrubber configures the background verification of sealed region checksums.
+type Scrubber struct {
 	Enable bool  `json:"enable"`
-	Second int64 `json:"second"`
+	Second int64 `json:"second"` // Interval between two passes over all sealed regions
+	Rate   int64 `json:"rate"`   // Maximum read rate in KB per second
+}
+
+// Encryption configures AES-GCM encryption at rest. Keys are "<id>:<hex key>" entries
+// separated by new lines or commas, the key with the largest id encrypts new data.
+type Encryption struct {
+	Enable  bool   `json:"enable"`
+	KeyFile string `json:"key_file" mapstructure:"key_file"` // File of encryption keys
+	KeyEnv  string `json:"key_env" mapstructure:"key_env"`   // Environment variable of encryption keys, takes precedence over KeyFile
+}
+
+// Compression configures the compression of record values.
+type Compression struct {
+	Codec   string `json:"codec"`                            // CodecNone, CodecSnappy or CodecZstd
+	MinSize int    `json:"min_size" mapstructure:"min_size"` // Values smaller than this in bytes are not compressed
+}
+
+// Index configures the sharding of the in-memory index.
+type Index struct {
+	Shards   int  `json:"shards"`   // Number of shards, a power of two, 0 picks one by CPU count
+	Adaptive bool `json:"adaptive"` // Double the shards online under lock contention
+}
+
+// Memory configures the pure in-memory storage mode.
+type Memory struct {
+	Enable    bool   `json:"enable"`
+	MaxMemory int64  `json:"max_memory" mapstructure:"max_memory"` // Memory limit in MB, 0 means unlimited
+	Eviction  string `json:"eviction"`
+}
+
+type Compressor struct {
+	Enable    bool    `json:"enable"`
+	Second    int64   `json:"second"`
+	Threshold float64 `json:"threshold"`
 }
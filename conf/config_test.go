@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestConfigLoad(t *testing.T) {
@@ -253,3 +254,175 @@ func TestServerConfig_ToString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSync(t *testing.T) {
+	tests := []struct {
+		value    string
+		mode     SyncMode
+		interval time.Duration
+		wantErr  bool
+	}{
+		{"", SyncAlways, 0, false},
+		{"always", SyncAlways, 0, false},
+		{"os", SyncOS, 0, false},
+		{"every 100ms", SyncEvery, 100 * time.Millisecond, false},
+		{"every 0ms", 0, 0, true},
+		{"sometimes", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		mode, interval, err := ParseSync(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSync(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if mode != tt.mode || interval != tt.interval {
+			t.Errorf("ParseSync(%q) = %v, %v, want %v, %v", tt.value, mode, interval, tt.mode, tt.interval)
+		}
+	}
+}
+
+func TestVaildated_MemoryMode(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := opt.Unmarshal([]byte(DefaultConfigJSON)); err != nil {
+		t.Fatal(err)
+	}
+	opt.Password = "password"
+	opt.Path = ""
+
+	if err := Vaildated(opt); err == nil {
+		t.Error("Vaildated() should reject an empty path on disk")
+	}
+
+	// 纯内存存储模式不需要数据目录
+	opt.Memory.Enable = true
+	if err := Vaildated(opt); err != nil {
+		t.Errorf("Vaildated() error: %v", err)
+	}
+
+	opt.Memory.Eviction = "random"
+	if err := Vaildated(opt); err == nil {
+		t.Error("Vaildated() should reject unknown eviction policy")
+	}
+}
+
+func TestVaildated_IndexShards(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := opt.Unmarshal([]byte(DefaultConfigJSON)); err != nil {
+		t.Fatal(err)
+	}
+	opt.Password = "password"
+
+	for _, shards := range []int{0, 1, 64} {
+		opt.Index.Shards = shards
+		if err := Vaildated(opt); err != nil {
+			t.Errorf("Vaildated() with %d shards error: %v", shards, err)
+		}
+	}
+
+	for _, shards := range []int{-1, 5} {
+		opt.Index.Shards = shards
+		if err := Vaildated(opt); err == nil {
+			t.Errorf("Vaildated() should reject %d shards", shards)
+		}
+	}
+}
+
+func TestVaildated_Region(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := opt.Unmarshal([]byte(DefaultConfigJSON)); err != nil {
+		t.Fatal(err)
+	}
+	opt.Password = "password"
+
+	opt.Region = MaxRegion
+	if err := Vaildated(opt); err != nil {
+		t.Errorf("Vaildated() with the largest region error: %v", err)
+	}
+
+	opt.Region = MaxRegion + 1
+	if err := Vaildated(opt); err == nil {
+		t.Error("Vaildated() should reject regions larger than 4 GiB")
+	}
+}
+
+func TestVaildated_Encryption(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := opt.Unmarshal([]byte(DefaultConfigJSON)); err != nil {
+		t.Fatal(err)
+	}
+	opt.Password = "password"
+	opt.Encryption.Enable = true
+
+	if err := Vaildated(opt); err != nil {
+		t.Errorf("Vaildated() with key environment variable error: %v", err)
+	}
+
+	opt.Encryption.KeyEnv = ""
+	if err := Vaildated(opt); err == nil {
+		t.Error("Vaildated() should reject encryption without keys")
+	}
+}
+
+func TestConfigLoad_Compression(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := Load(filepath.Join("..", "config.yaml"), opt); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	if opt.Compression.Codec != CodecNone || opt.Compression.MinSize != 256 {
+		t.Errorf("Load() compression = %+v, want codec %s and min size 256", opt.Compression, CodecNone)
+	}
+}
+
+func TestConfigLoad_Encryption(t *testing.T) {
+	opt := new(ServerConfig)
+	if err := Load(filepath.Join("..", "config.yaml"), opt); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if opt.Encryption.KeyEnv != "VASEDB_ENCRYPTION_KEY" {
+		t.Errorf("Load() key env = %q, want VASEDB_ENCRYPTION_KEY", opt.Encryption.KeyEnv)
+	}
+
+	configFile := filepath.Join(t.TempDir(), "test-config.yaml")
+	testConfigData := []byte(`
+encryption:
+  enable: true
+  key_file: /etc/vasedb/keys
+  key_env: TEST_ENCRYPTION_KEY
+`)
+	if err := os.WriteFile(configFile, testConfigData, 0644); err != nil {
+		t.Fatalf("Error writing test config file: %v", err)
+	}
+
+	opt = new(ServerConfig)
+	if err := Load(configFile, opt); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	want := Encryption{Enable: true, KeyFile: "/etc/vasedb/keys", KeyEnv: "TEST_ENCRYPTION_KEY"}
+	if opt.Encryption != want {
+		t.Errorf("Load() encryption = %+v, want %+v", opt.Encryption, want)
+	}
+}
+
+func TestConfigLoad_Memory(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "test-config.yaml")
+	testConfigData := []byte(`
+memory:
+  enable: true
+  max_memory: 512
+  eviction: lfu
+`)
+	if err := os.WriteFile(configFile, testConfigData, 0644); err != nil {
+		t.Fatalf("Error writing test config file: %v", err)
+	}
+
+	opt := new(ServerConfig)
+	if err := Load(configFile, opt); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	want := Memory{Enable: true, MaxMemory: 512, Eviction: EvictLFU}
+	if opt.Memory != want {
+		t.Errorf("Load() memory = %+v, want %+v", opt.Memory, want)
+	}
+}
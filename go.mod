@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/fatih/color v1.13.0
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.16.5
 	github.com/spf13/viper v1.16.0
 	gopkg.in/yaml.v2 v2.4.0
 )
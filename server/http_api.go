@@ -1,17 +1,28 @@
 package server
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/auula/vasedb/clog"
 	"github.com/auula/vasedb/types"
+	"github.com/auula/vasedb/vfs"
 	"github.com/gorilla/mux"
 )
 
 const version = "vasedb/0.1.1"
 
+const (
+	// 扫描接口默认和最大返回的 key 数量
+	defaultScanCount = 100
+	maxScanCount     = 1000
+)
+
 var (
 	root         *mux.Router
 	authPassword string
@@ -22,6 +33,14 @@ func init() {
 	root = mux.NewRouter()
 	root.Use(authMiddleware)
 	root.HandleFunc("/", action).Methods(allowMethod...)
+	root.HandleFunc("/ttl/{key}", ttlAction).Methods("GET")
+	root.HandleFunc("/expire/{key}", expireAction).Methods("PUT")
+	root.HandleFunc("/persist/{key}", persistAction).Methods("PUT")
+	root.HandleFunc("/scan", scanAction).Methods("GET")
+	root.HandleFunc("/stats/shards", shardStatsAction).Methods("GET")
+	root.HandleFunc("/stats/compression", compressionStatsAction).Methods("GET")
+	root.HandleFunc("/stats/scrub", scrubStatsAction).Methods("GET")
+	root.HandleFunc("/backup", backupAction).Methods("GET")
 }
 
 type ResponseBody struct {
@@ -56,6 +75,193 @@ func action(w http.ResponseWriter, r *http.Request) {
 	okResponse(w, http.StatusOK, tables, "Request processed successfully!")
 }
 
+// errorResponse 根据存储引擎返回的错误设置响应状态码
+func errorResponse(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, vfs.ErrSegmentNotFound) {
+		code = http.StatusNotFound
+	} else {
+		clog.Error(err)
+	}
+	okResponse(w, code, nil, err.Error())
+}
+
+// ttlAction 返回 key 剩余的存活秒数，-1 表示永不过期
+func ttlAction(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	ttl, err := storage.TTL(key)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	seconds := int64(-1)
+	if ttl != vfs.NoExpiration {
+		seconds = int64(ttl / time.Second)
+	}
+
+	result := []interface{}{
+		map[string]interface{}{"key": key, "ttl": seconds},
+	}
+	okResponse(w, http.StatusOK, result, "Request processed successfully!")
+}
+
+// expireAction 设置 key 的存活秒数，例如 PUT /expire/{key}?seconds=60
+func expireAction(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseInt(r.URL.Query().Get("seconds"), 10, 64)
+	if err != nil || seconds <= 0 {
+		okResponse(w, http.StatusBadRequest, nil, "seconds must be a positive integer")
+		return
+	}
+
+	err = storage.ExpireSegment(mux.Vars(r)["key"], time.Duration(seconds)*time.Second)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	okResponse(w, http.StatusOK, nil, "Request processed successfully!")
+}
+
+// persistAction 移除 key 的过期时间
+func persistAction(w http.ResponseWriter, r *http.Request) {
+	err := storage.PersistSegment(mux.Vars(r)["key"])
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	okResponse(w, http.StatusOK, nil, "Request processed successfully!")
+}
+
+// scanAction 按字节序分页返回 key，例如 GET /scan?prefix=user:&count=100&cursor=...&reverse=true
+// 返回的 next_cursor 为空时表示已经扫描完成
+func scanAction(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	count := defaultScanCount
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxScanCount {
+			okResponse(w, http.StatusBadRequest, nil, "count must be an integer between 1 and "+strconv.Itoa(maxScanCount))
+			return
+		}
+		count = n
+	}
+
+	reverse := false
+	if value := query.Get("reverse"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			okResponse(w, http.StatusBadRequest, nil, "reverse must be a boolean")
+			return
+		}
+		reverse = b
+	}
+
+	it := storage.Prefix(query.Get("prefix"))
+	if reverse {
+		it = it.Reverse()
+	}
+
+	// 游标是上一页最后一个 key 的 base64url 编码
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			okResponse(w, http.StatusBadRequest, nil, "cursor is not valid")
+			return
+		}
+		it = it.After(string(cursor))
+	}
+
+	keys := make([]string, 0, count)
+	for len(keys) < count && it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	next := ""
+	if len(keys) == count && it.Next() {
+		next = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+
+	result := []interface{}{
+		map[string]interface{}{"keys": keys, "next_cursor": next},
+	}
+	okResponse(w, http.StatusOK, result, "Request processed successfully!")
+}
+
+// shardStatsAction 返回每个索引分片的锁竞争情况，只有磁盘存储模式支持
+func shardStatsAction(w http.ResponseWriter, r *http.Request) {
+	lfs, ok := storage.(*vfs.LogStructuredFS)
+	if !ok {
+		okResponse(w, http.StatusNotImplemented, nil, "index shards are not used by the in-memory storage")
+		return
+	}
+
+	stats := lfs.ShardStats()
+	result := make([]interface{}, 0, len(stats))
+	for _, stat := range stats {
+		result = append(result, stat)
+	}
+	okResponse(w, http.StatusOK, result, "Request processed successfully!")
+}
+
+// compressionStatsAction 返回启动以来写入的 value 的压缩比例，只有磁盘存储模式支持
+func compressionStatsAction(w http.ResponseWriter, r *http.Request) {
+	lfs, ok := storage.(*vfs.LogStructuredFS)
+	if !ok {
+		okResponse(w, http.StatusNotImplemented, nil, "values are not compressed by the in-memory storage")
+		return
+	}
+
+	result := []interface{}{lfs.CompressionStats()}
+	okResponse(w, http.StatusOK, result, "Request processed successfully!")
+}
+
+// scrubStatsAction 返回后台校验的进度和发现的损坏数据文件，只有磁盘存储模式支持
+func scrubStatsAction(w http.ResponseWriter, r *http.Request) {
+	lfs, ok := storage.(*vfs.LogStructuredFS)
+	if !ok {
+		okResponse(w, http.StatusNotImplemented, nil, "regions are not scrubbed by the in-memory storage")
+		return
+	}
+
+	result := []interface{}{lfs.ScrubStats()}
+	okResponse(w, http.StatusOK, result, "Request processed successfully!")
+}
+
+// backupAction 以 tar 格式流式导出一致性快照，可以在不停机的情况下备份，只有磁盘存储模式支持
+func backupAction(w http.ResponseWriter, r *http.Request) {
+	lfs, ok := storage.(*vfs.LogStructuredFS)
+	if !ok {
+		okResponse(w, http.StatusNotImplemented, nil, "backup is not supported by the in-memory storage")
+		return
+	}
+
+	snap, err := lfs.Snapshot()
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	defer snap.Close()
+
+	// 备份文件可能很大，导出期间取消写超时
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		clog.Warnf("Failed to clear write deadline of backup: %v", err)
+	}
+
+	name := fmt.Sprintf("vasedb-%s.tar", snap.CreatedAt().Format("20060102150405"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Server", version)
+	w.WriteHeader(http.StatusOK)
+
+	// 响应头已经发送，导出失败时只能记录日志，客户端会收到不完整的 tar 文件
+	if _, err := snap.WriteTo(w); err != nil {
+		clog.Errorf("Failed to stream backup: %v", err)
+	}
+}
+
 func unauthorizedResponse(w http.ResponseWriter, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Server", version)
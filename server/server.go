@@ -17,7 +17,7 @@ import (
 var (
 	// ipv4 return local IPv4 address
 	ipv4    string = "127.0.0.1"
-	storage *vfs.LogStructuredFS
+	storage vfs.Storage
 )
 
 const (
@@ -89,7 +89,13 @@ func New(opt *Options) (*HttpServer, error) {
 	return &hs, nil
 }
 
-func SetupFS(fss *vfs.LogStructuredFS) {
+// LocalIPv4 returns the local IPv4 address the HTTP server listens on.
+func LocalIPv4() string {
+	return ipv4
+}
+
+// SetupFS sets the storage used by the HTTP API, on disk or in memory.
+func SetupFS(fss vfs.Storage) {
 	storage = fss
 }
 
@@ -25,7 +25,10 @@ func IsDir(path string) bool {
 }
 
 // CloseFile 封装了文件的 Sync 和 Close 操作，减少重复代码
-func CloseFile(file *os.File) error {
+func CloseFile(file interface {
+	Sync() error
+	Close() error
+}) error {
 	if err := file.Sync(); err != nil {
 		return fmt.Errorf("failed to sync file: %w", err)
 	}
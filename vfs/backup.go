@@ -0,0 +1,250 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+// Snapshot is a consistent point-in-time view of a LogStructuredFS for online backup.
+// The regions it references are pinned against compaction until Close is called.
+type Snapshot struct {
+	lfs       *LogStructuredFS
+	createdAt time.Time
+	regions   []snapshotRegion
+	index     []byte // Sealed index snapshot matching the regions
+	closeOnce sync.Once
+}
+
+// snapshotRegion 是快照中的一个数据文件，只导出快照时的大小
+type snapshotRegion struct {
+	id   uint16
+	size int64
+	file File
+}
+
+// Snapshot seals the active region and freezes the regions and the index at this moment,
+// writes after Snapshot returns are not part of it. The caller must Close the snapshot.
+func (lfs *LogStructuredFS) Snapshot() (*Snapshot, error) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	select {
+	case <-lfs.closed:
+		return nil, errors.New("file system already closed")
+	default:
+	}
+
+	// 封存有数据的活跃数据文件，快照中的数据文件都不会再被写入
+	if lfs.offset > lfs.regionHeaders[lfs.regionID].size() {
+		if err := lfs.rotateRegion(); err != nil {
+			return nil, fmt.Errorf("failed to seal active region: %w", err)
+		}
+	}
+
+	index, err := lfs.encodeIndexSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if index, err = lfs.sealSnapshot(index); err != nil {
+		return nil, fmt.Errorf("failed to encrypt index snapshot: %w", err)
+	}
+
+	snap := &Snapshot{lfs: lfs, createdAt: time.Now(), index: index}
+
+	// 空的活跃数据文件也需要导出，索引快照中记录了它的高水位
+	sizes := map[uint16]int64{lfs.regionID: lfs.offset}
+	for id, file := range lfs.regions {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat region %d: %w", id, err)
+		}
+		sizes[id] = info.Size()
+	}
+
+	for id, size := range sizes {
+		// 使用独立的文件句柄，导出期间不受活跃数据文件切换和关闭的影响
+		file, err := lfs.fs.OpenFile(filepath.Join(lfs.path, regionFileName(id)), os.O_RDONLY, 0)
+		if err != nil {
+			snap.closeFiles()
+			return nil, fmt.Errorf("failed to open region %d: %w", id, err)
+		}
+		snap.regions = append(snap.regions, snapshotRegion{id: id, size: size, file: file})
+	}
+	sort.Slice(snap.regions, func(i, j int) bool {
+		return snap.regions[i].id < snap.regions[j].id
+	})
+
+	for _, region := range snap.regions {
+		lfs.pins[region.id]++
+	}
+
+	return snap, nil
+}
+
+// CreatedAt returns the time the snapshot was taken.
+func (s *Snapshot) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+// WriteTo streams the snapshot as a tar archive of the region files and the index snapshot,
+// which can be extracted into an empty directory and opened by OpenFS.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	tw := tar.NewWriter(cw)
+
+	for _, region := range s.regions {
+		err := writeTarFile(tw, regionFileName(region.id), region.size, s.createdAt,
+			io.NewSectionReader(region.file, 0, region.size))
+		if err != nil {
+			return cw.n, fmt.Errorf("failed to export region %d: %w", region.id, err)
+		}
+	}
+
+	err := writeTarFile(tw, indexSnapshotFile, int64(len(s.index)), s.createdAt, bytes.NewReader(s.index))
+	if err != nil {
+		return cw.n, fmt.Errorf("failed to export index snapshot: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return cw.n, err
+	}
+
+	clog.Infof("Exported snapshot of %s with %d regions (%d bytes)", s.lfs.path, len(s.regions), cw.n)
+
+	return cw.n, nil
+}
+
+// Close releases the pinned regions so compaction can reclaim them again.
+func (s *Snapshot) Close() error {
+	s.closeOnce.Do(func() {
+		s.lfs.mu.Lock()
+		for _, region := range s.regions {
+			if s.lfs.pins[region.id]--; s.lfs.pins[region.id] <= 0 {
+				delete(s.lfs.pins, region.id)
+			}
+		}
+		s.lfs.mu.Unlock()
+
+		s.closeFiles()
+	})
+	return nil
+}
+
+func (s *Snapshot) closeFiles() {
+	for _, region := range s.regions {
+		region.file.Close()
+	}
+}
+
+// ExportDir writes the region files and the index snapshot of the stopped data directory at path
+// as a tar archive in the layout of Snapshot.WriteTo. The directory is only read, not opened by
+// OpenFS, so recovery, rotation and background tasks never modify it. Restore truncates a torn tail
+// of the active region and ignores a stale index snapshot like OpenFS does.
+// opts supplies the file system, nil uses the defaults.
+func ExportDir(path string, opts *Options, w io.Writer) (int64, error) {
+	if opts == nil {
+		opts = NewOptions(conf.Default)
+	}
+	o := *opts
+	if err := o.validate(); err != nil {
+		return 0, fmt.Errorf("invalid file system options: %w", err)
+	}
+	fsys := o.FileSystem
+
+	if _, err := fsys.Stat(path); err != nil {
+		return 0, fmt.Errorf("data directory is not available: %w", err)
+	}
+
+	// 持有目录锁，保证导出期间没有实例在写入
+	lock, err := lockDir(fsys, path)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+
+	names, err := fsys.ReadDir(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	cw := &countWriter{w: w}
+	tw := tar.NewWriter(cw)
+	createdAt := time.Now()
+	files := 0
+	for _, name := range names {
+		if !isBackupFile(name) {
+			continue
+		}
+		if err := exportFile(fsys, tw, filepath.Join(path, name), createdAt); err != nil {
+			return cw.n, fmt.Errorf("failed to export %s: %w", name, err)
+		}
+		files++
+	}
+
+	if err := tw.Close(); err != nil {
+		return cw.n, err
+	}
+
+	clog.Infof("Exported data directory %s with %d files (%d bytes)", path, files, cw.n)
+
+	return cw.n, nil
+}
+
+// exportFile 将文件当前的全部内容写入 tar
+func exportFile(fsys FileSystem, tw *tar.Writer, name string, modTime time.Time) error {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeTarFile(tw, filepath.Base(name), info.Size(), modTime, io.NewSectionReader(file, 0, info.Size()))
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(conf.FsPerm),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tw, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,190 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// extractTestTar 将 tar 文件解压到 dir
+func extractTestTar(t *testing.T, r io.Reader, dir string) []string {
+	t.Helper()
+
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, hdr.Name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestLogStructuredFS_Snapshot(t *testing.T) {
+	lfs := openTestFS(t, t.TempDir())
+	defer lfs.CloseFS()
+	lfs.regionThreshold = 512
+
+	for i := 0; i < 20; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 快照期间的并发写入不会出现在快照中
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := lfs.PutSegment(fmt.Sprintf("concurrent-%d", i), newTestSegment("value")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	snap, err := lfs.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error: %v", err)
+	}
+	defer snap.Close()
+	wg.Wait()
+
+	// 快照引用的数据文件不会被压缩
+	for i := 0; i < 20; i++ {
+		if err := lfs.DeleteSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lfs.PutSegment("after", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, region := range snap.regions {
+		if _, err := os.Stat(filepath.Join(lfs.path, regionFileName(region.id))); err != nil {
+			t.Errorf("pinned region %d was compacted: %v", region.id, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error: %v", err)
+	}
+	snap.Close()
+
+	lfs.mu.RLock()
+	pins := len(lfs.pins)
+	lfs.mu.RUnlock()
+	if pins != 0 {
+		t.Errorf("%d regions are still pinned after Close()", pins)
+	}
+
+	dir := t.TempDir()
+	names := extractTestTar(t, &buf, dir)
+	if names[len(names)-1] != indexSnapshotFile {
+		t.Errorf("archive files = %v, want the index snapshot last", names)
+	}
+
+	restored := openTestFS(t, dir)
+	defer restored.CloseFS()
+
+	for i := 0; i < 20; i++ {
+		if _, err := restored.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) error: %v", i, err)
+		}
+	}
+	if _, err := restored.FetchSegment("after"); err == nil {
+		t.Error("write after the snapshot is in the backup")
+	}
+}
+
+// readTestDir 返回目录中除了目录锁之外的全部文件内容
+func readTestDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestExportDir(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 512
+	for i := 0; i < 20; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ExportDir(dir, nil, io.Discard); err == nil {
+		t.Error("ExportDir() should fail while the directory is in use")
+	}
+
+	// 崩溃之后活跃数据文件末尾有写入了一半的记录，导出不能修改数据目录
+	crashTestFS(lfs)
+	torn := &Segment{kind: Text, key: "torn", data: []byte("value")}
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(lfs.regionID)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn.ToBytes()[:recordHeaderSize+2])
+	file.Close()
+
+	before := readTestDir(t, dir)
+	var buf bytes.Buffer
+	if _, err := ExportDir(dir, nil, &buf); err != nil {
+		t.Fatalf("ExportDir() error: %v", err)
+	}
+	if after := readTestDir(t, dir); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Error("ExportDir() modified the data directory")
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup.tar")
+	if err := os.WriteFile(backup, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restored := t.TempDir()
+	if _, err := Restore(backup, restored, nil, nil); err != nil {
+		t.Fatalf("Restore() error: %v", err)
+	}
+	lfs = openTestFS(t, restored)
+	defer lfs.CloseFS()
+	for i := 0; i < 20; i++ {
+		if _, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) from exported backup error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Batch frame layout: a regular record with flagBatch set and an empty key,
+// whose value holds the complete records of the batch and a commit marker:
+//
+//	+--------------+----------+-----+----------+---------------+
+//	| Frame Header | Record 1 | ... | Record N | Commit Marker |
+//	| 31 bytes     |          |     |          | 4 + 4 bytes   |
+//	+--------------+----------+-----+----------+---------------+
+//
+// Commit Marker 由 batchCommitMagic 和记录条数 N 组成。整个批次只依赖帧头部的一个 Checksum，
+// 恢复时校验失败的批次会被整体丢弃，所以要么全部生效，要么全部不生效。
+// 批次中的每条记录都保持完整的记录格式，索引可以直接指向批次内部的记录。
+const (
+	batchMarkerSize = 8
+)
+
+var (
+	batchCommitMagic = []byte{0xDB, 0xBA, 0x7C, 0xED}
+
+	// ErrEmptyBatch is returned when committing a batch without any operation
+	ErrEmptyBatch = errors.New("write batch is empty")
+)
+
+// WriteBatch stages puts and deletes of multiple keys which are
+// written as one frame and applied atomically.
+type WriteBatch struct {
+	segments []*Segment
+}
+
+// NewWriteBatch returns an empty write batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{segments: make([]*Segment, 0)}
+}
+
+// Put stages a copy of seg to be stored under key.
+func (wb *WriteBatch) Put(key string, seg *Segment) {
+	staged := cloneSegment(seg)
+	staged.key = key
+	wb.segments = append(wb.segments, staged)
+}
+
+// Delete stages the deletion of key.
+func (wb *WriteBatch) Delete(key string) {
+	wb.segments = append(wb.segments, &Segment{kind: Binary, flags: flagTombstone, key: key})
+}
+
+// Len returns the number of staged operations.
+func (wb *WriteBatch) Len() int {
+	return len(wb.segments)
+}
+
+// Reset clears all staged operations so the batch can be reused.
+func (wb *WriteBatch) Reset() {
+	wb.segments = wb.segments[:0]
+}
+
+// batchEntry 是展开批次之后的一条记录和它在数据文件中的偏移量
+type batchEntry struct {
+	offset int64
+	seg    *Segment
+}
+
+// isBatch 判断记录是否是批次帧
+func (s *Segment) isBatch() bool {
+	return s.flags&flagBatch != 0
+}
+
+// BatchINodes writes all operations of wb as one atomic frame and applies them to the index.
+func (lfs *LogStructuredFS) BatchINodes(wb *WriteBatch) error {
+	if err := lfs.applyBatch(wb); err != nil {
+		return err
+	}
+
+	return lfs.commitSync()
+}
+
+func (lfs *LogStructuredFS) applyBatch(wb *WriteBatch) error {
+	if wb.Len() == 0 {
+		return ErrEmptyBatch
+	}
+
+	for _, seg := range wb.segments {
+		if seg.key == "" {
+			return errors.New("segment key is empty")
+		}
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	aead, err := lfs.regionCipher(lfs.regionID)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, len(wb.segments))
+	stored := make([]*Segment, len(wb.segments))
+	for i, seg := range wb.segments {
+		// 批次可以重复提交，时间戳只写入副本
+		record := *seg
+		record.createdAt = lfs.nextTimestamp()
+		stored[i] = withEncryption(lfs.compressSegment(&record), aead)
+		encoded, err := encodeRecord(stored[i], aead)
+		if err != nil {
+			return fmt.Errorf("failed to encode segment: %w", err)
+		}
+		offsets[i] = int64(buf.Len())
+		buf.Write(encoded)
+	}
+
+	buf.Write(batchCommitMagic)
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(wb.segments))))
+
+	frame := &Segment{kind: Binary, flags: flagBatch, data: buf.Bytes()}
+	inode, err := lfs.appendSegment(frame)
+	if err != nil {
+		return err
+	}
+
+	stat := lfs.stats[inode.RegionID]
+	if first := stored[0].createdAt; first < stat.minCreated {
+		stat.minCreated = first
+	}
+	// 帧头部和提交标记不会被索引引用
+	stat.garbage += recordHeaderSize + batchMarkerSize
+
+	base := int64(inode.Offset) + recordHeaderSize
+	for i, seg := range stored {
+		latest := newINode(inode.RegionID, base+offsets[i], seg)
+		if seg.IsTombstone() {
+			lfs.markGarbage(latest)
+			if old := lfs.removeINode(seg.key); old != nil {
+				lfs.markGarbage(old)
+			}
+			continue
+		}
+		if old := lfs.swapINode(seg.key, latest); old != nil {
+			lfs.markGarbage(old)
+		}
+	}
+
+	return nil
+}
+
+// unpackRecord 展开数据文件中 offset 处的记录，批次帧会被展开为内部的每一条记录，
+// 内部的记录使用数据文件的 aead 解密
+func unpackRecord(offset int64, seg *Segment, aead cipher.AEAD) ([]batchEntry, error) {
+	if !seg.isBatch() {
+		return []batchEntry{{offset: offset, seg: seg}}, nil
+	}
+
+	data := seg.data
+	if len(data) < batchMarkerSize || !bytes.Equal(data[len(data)-batchMarkerSize:len(data)-4], batchCommitMagic) {
+		return nil, fmt.Errorf("%w: batch at offset %d has no commit marker", ErrInvalidHeader, offset)
+	}
+
+	count := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	data = data[:len(data)-batchMarkerSize]
+
+	base := offset + recordHeaderSize + int64(len(seg.key))
+	entries := make([]batchEntry, 0, count)
+	for pos := 0; pos < len(data); {
+		inner, err := decodeRecord(data[pos:], aead)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batch at offset %d: %w", offset, err)
+		}
+		if inner.isBatch() {
+			return nil, fmt.Errorf("%w: nested batch at offset %d", ErrInvalidHeader, offset)
+		}
+		entries = append(entries, batchEntry{offset: base + int64(pos), seg: inner})
+		pos += inner.recordSize()
+	}
+
+	if len(entries) != count {
+		return nil, fmt.Errorf("%w: batch at offset %d has %d of %d records", ErrInvalidHeader, offset, len(entries), count)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatch_Apply(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if err := lfs.PutSegment("deleted", newTestSegment("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lfs.BatchINodes(NewWriteBatch()); !errors.Is(err, ErrEmptyBatch) {
+		t.Errorf("BatchINodes() = %v, want %v", err, ErrEmptyBatch)
+	}
+
+	wb := NewWriteBatch()
+	wb.Put("hello", newTestSegment("world"))
+	wb.Put("foo", newTestSegment("bar"))
+	wb.Delete("deleted")
+
+	if err := lfs.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+
+	for key, want := range map[string]string{"hello": "world", "foo": "bar"} {
+		seg, err := lfs.FetchSegment(key)
+		if err != nil {
+			t.Fatalf("FetchSegment(%s) error: %v", key, err)
+		}
+		if string(seg.data) != want {
+			t.Errorf("FetchSegment(%s) = %s, want %s", key, seg.data, want)
+		}
+	}
+
+	if _, err := lfs.FetchSegment("deleted"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(deleted) = %v, want %v", err, ErrSegmentNotFound)
+	}
+}
+
+func TestWriteBatch_Recover(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	wb := NewWriteBatch()
+	wb.Put("hello", newTestSegment("world"))
+	wb.Put("foo", newTestSegment("bar"))
+	if err := lfs.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+	committed := lfs.offset
+
+	wb.Reset()
+	wb.Put("hello", newTestSegment("torn"))
+	wb.Put("other", newTestSegment("torn"))
+	if err := lfs.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+	torn := lfs.offset
+	crashTestFS(lfs)
+
+	// 模拟第二个批次只写入了一部分
+	path := filepath.Join(dir, regionFileName(1))
+	if err := os.Truncate(path, committed+(torn-committed)/2); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if lfs.offset != committed {
+		t.Errorf("offset after recovery = %d, want %d", lfs.offset, committed)
+	}
+
+	seg, err := lfs.FetchSegment("hello")
+	if err != nil || string(seg.data) != "world" {
+		t.Errorf("FetchSegment(hello) = %v, %v", seg, err)
+	}
+	if _, err := lfs.FetchSegment("other"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(other) = %v, want %v", err, ErrSegmentNotFound)
+	}
+}
+
+func TestWriteBatch_Compact(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	wb := NewWriteBatch()
+	wb.Put("hello", newTestSegment("world"))
+	wb.Put("foo", newTestSegment("bar"))
+	if err := lfs.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+	if err := lfs.PutSegment("foo", newTestSegment("baz")); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs.mu.Lock()
+	err := lfs.rotateRegion()
+	lfs.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lfs.compressor.compactRegion(1); err != nil {
+		t.Fatalf("compactRegion() error: %v", err)
+	}
+
+	check := func(lfs *LogStructuredFS) {
+		for key, want := range map[string]string{"hello": "world", "foo": "baz"} {
+			seg, err := lfs.FetchSegment(key)
+			if err != nil {
+				t.Fatalf("FetchSegment(%s) error: %v", key, err)
+			}
+			if string(seg.data) != want {
+				t.Errorf("FetchSegment(%s) = %s, want %s", key, seg.data, want)
+			}
+		}
+	}
+
+	check(lfs)
+
+	crashTestFS(lfs)
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	check(lfs)
+}
@@ -0,0 +1,626 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+var (
+	// 修复时损坏的数据文件被重命名保留，方便事后分析
+	damagedFileExtension = ".damaged"
+
+	// 校验数据文件时每次读取的字节数，整个数据文件不会同时读入内存
+	checkWindowSize = 1 << 20
+)
+
+// CheckReport is the result of checking a data directory offline.
+type CheckReport struct {
+	Path        string          `json:"path"`
+	Regions     []*RegionReport `json:"regions"`
+	Dangling    []string        `json:"dangling"`    // Keys of index snapshot entries without a valid record
+	Lost        []string        `json:"lost"`        // Keys whose latest record is corrupted, Repair deletes them
+	Orphans     []string        `json:"orphans"`     // Files which do not belong to the data directory
+	Quarantined []string        `json:"quarantined"` // Damaged regions kept aside by Repair or the scrubber
+	Snapshot    string          `json:"snapshot"`    // Error of the index snapshot, empty when valid or absent
+	Repaired    []uint16        `json:"repaired"`    // Regions rewritten with their valid records by Repair
+}
+
+// RegionReport is the result of verifying every record of a region.
+type RegionReport struct {
+	ID        uint16         `json:"id"`
+	Size      int64          `json:"size"`
+	Format    string         `json:"format,omitempty"` // File format version, empty when the header is unreadable
+	Records   int            `json:"records"`          // Number of valid records, a batch counts its inner records
+	Corrupted []CorruptRange `json:"corrupted"`
+	Error     string         `json:"error,omitempty"` // Error which stopped the check of the region
+}
+
+// CorruptRange is a byte range of a region which contains no valid record.
+type CorruptRange struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Reason string `json:"reason"`
+}
+
+// Healthy reports whether the check found no problem.
+func (r *CheckReport) Healthy() bool {
+	for _, region := range r.Regions {
+		if !region.healthy() {
+			return false
+		}
+	}
+	return len(r.Dangling) == 0 && len(r.Orphans) == 0 && r.Snapshot == ""
+}
+
+func (r *RegionReport) healthy() bool {
+	return len(r.Corrupted) == 0 && r.Error == ""
+}
+
+// CorruptedBytes returns the number of bytes in the corrupted ranges.
+func (r *RegionReport) CorruptedBytes() int64 {
+	var n int64
+	for _, c := range r.Corrupted {
+		n += c.End - c.Start
+	}
+	return n
+}
+
+// recordMeta 是一条校验通过的记录的元数据，跨数据文件的检查只需要这些字段，不保留 value
+type recordMeta struct {
+	key       string
+	offset    int64
+	length    uint32
+	createdAt int64
+}
+
+// validRecord 是数据文件中一条校验通过的记录，批次帧展开为内部记录的元数据
+type validRecord struct {
+	start, end int64
+	entries    []recordMeta
+}
+
+// regionScan 是一个数据文件的完整校验结果，只保存记录的位置和元数据
+type regionScan struct {
+	report  *RegionReport
+	header  fileHeader
+	records []validRecord
+	damaged map[string]int64 // Keys and timestamps readable from the headers of damaged records
+}
+
+// Check verifies the data directory at path without opening it: the CRC and framing of
+// every record, the index snapshot entries and unexpected files. The directory must not be
+// in use. opts supplies the file system and the encryption keys, nil uses the defaults.
+func Check(path string, opts *Options) (*CheckReport, error) {
+	return check(path, opts, false)
+}
+
+// Repair checks the data directory like Check, then rewrites every damaged region with its
+// valid records, keeping the original as a .damaged file, appends tombstones for the lost keys
+// so their older records are not restored, and removes the stale index snapshot and temporary
+// files so the next OpenFS rebuilds the index from the repaired regions.
+func Repair(path string, opts *Options) (*CheckReport, error) {
+	return check(path, opts, true)
+}
+
+func check(path string, opts *Options, repair bool) (*CheckReport, error) {
+	if opts == nil {
+		opts = NewOptions(conf.Default)
+	}
+	o := *opts
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid file system options: %w", err)
+	}
+	fsys := o.FileSystem
+
+	if _, err := fsys.Stat(path); err != nil {
+		return nil, fmt.Errorf("data directory is not available: %w", err)
+	}
+
+	var kr *keyring
+	if o.Encryption {
+		var err error
+		if kr, err = loadKeyring(o.KeyFile, o.KeyEnv); err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+	}
+
+	// 持有目录锁，保证检查期间没有实例在写入
+	lock, err := lockDir(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	names, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	report := &CheckReport{Path: path, Dangling: []string{}, Lost: []string{}, Orphans: []string{}, Quarantined: []string{}, Repaired: []uint16{}}
+	scans := make(map[uint16]*regionScan)
+	for _, name := range names {
+		if id, ok := parseRegionID(name); ok {
+			scan, err := scanRegionFile(fsys, filepath.Join(path, name), id, kr)
+			if err != nil {
+				return nil, err
+			}
+			scans[id] = scan
+			report.Regions = append(report.Regions, scan.report)
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, dataFileExtension+damagedFileExtension):
+			report.Quarantined = append(report.Quarantined, name)
+		case name != indexSnapshotFile && name != lockFileName:
+			report.Orphans = append(report.Orphans, name)
+		}
+	}
+	sort.Slice(report.Regions, func(i, j int) bool {
+		return report.Regions[i].ID < report.Regions[j].ID
+	})
+
+	snap, err := loadIndexSnapshot(fsys, path, kr)
+	if err != nil {
+		report.Snapshot = err.Error()
+		snap = nil
+	} else if snap != nil {
+		report.Dangling = danglingEntries(snap, scans)
+	}
+
+	lost := lostKeys(snap, report.Dangling, scans)
+	for key := range lost {
+		report.Lost = append(report.Lost, key)
+	}
+	sort.Strings(report.Lost)
+
+	if repair {
+		if err := repairRegions(fsys, path, report, scans); err != nil {
+			return report, err
+		}
+		if err := writeTombstones(fsys, path, report, scans, lost, kr); err != nil {
+			return report, fmt.Errorf("failed to delete lost keys: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+// scanRegionFile 从头到尾校验数据文件中的每一条记录，遇到损坏的数据时向后查找下一条有效记录。
+// 数据文件按窗口读取，只保留校验通过的记录的元数据
+func scanRegionFile(fsys FileSystem, name string, id uint16, kr *keyring) (*regionScan, error) {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read region %d: %w", id, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read region %d: %w", id, err)
+	}
+
+	w := &regionWindow{file: file, size: info.Size()}
+	scan := &regionScan{
+		report:  &RegionReport{ID: id, Size: w.size, Corrupted: []CorruptRange{}},
+		damaged: make(map[string]int64),
+	}
+
+	scan.header, err = parseRegionHeader(w.slice(0, maxRegionHeaderSize), name)
+	if w.err != nil {
+		return nil, fmt.Errorf("failed to read region %d: %w", id, w.err)
+	}
+	if err != nil {
+		scan.report.Error = err.Error()
+		return scan, nil
+	}
+	scan.report.Format = scan.header.version.String()
+	aead, err := kr.aead(scan.header.keyID)
+	if err != nil {
+		scan.report.Error = err.Error()
+		return scan, nil
+	}
+
+	offset := scan.header.size()
+	for offset < w.size {
+		rec, err := w.decodeValidRecord(offset, aead)
+		if err == nil {
+			scan.records = append(scan.records, *rec)
+			scan.report.Records += len(rec.entries)
+			offset = rec.end
+			continue
+		}
+
+		// O_DIRECT 写入的末尾填充数据不是损坏
+		if rest := w.size - offset; rest < directBlockSize && allZero(w.slice(offset, int(rest))) {
+			break
+		}
+
+		start := offset
+		for offset = w.nextCandidate(start + 1); offset < w.size; offset = w.nextCandidate(offset + 1) {
+			if _, err := w.decodeValidRecord(offset, aead); err == nil {
+				break
+			}
+		}
+		if w.err != nil {
+			return nil, fmt.Errorf("failed to read region %d: %w", id, w.err)
+		}
+		scan.report.Corrupted = append(scan.report.Corrupted, CorruptRange{Start: start, End: offset, Reason: err.Error()})
+		if key, createdAt, ok := damagedRecordKey(w.slice(start, int(minInt64(offset-start, recordHeaderSize+maxKeySize)))); ok && createdAt > scan.damaged[key] {
+			scan.damaged[key] = createdAt
+		}
+	}
+	if w.err != nil {
+		return nil, fmt.Errorf("failed to read region %d: %w", id, w.err)
+	}
+
+	return scan, nil
+}
+
+// regionWindow 按窗口读取数据文件，读取失败时记录第一个错误并返回空的数据
+type regionWindow struct {
+	file File
+	size int64
+	base int64 // Offset of buf in the file
+	buf  []byte
+	err  error
+}
+
+// slice 返回文件中 [offset, offset+n) 的数据，超出文件末尾的部分被截断，
+// 返回的数据在下一次调用之前有效
+func (w *regionWindow) slice(offset int64, n int) []byte {
+	end := minInt64(offset+int64(n), w.size)
+	if offset >= end || w.err != nil {
+		return nil
+	}
+	if offset >= w.base && end <= w.base+int64(len(w.buf)) {
+		return w.buf[offset-w.base : end-w.base]
+	}
+
+	size := end - offset
+	if size < int64(checkWindowSize) {
+		size = minInt64(int64(checkWindowSize), w.size-offset)
+	}
+	if int64(cap(w.buf)) < size {
+		w.buf = make([]byte, size)
+	}
+	w.buf = w.buf[:size]
+	if _, err := w.file.ReadAt(w.buf, offset); err != nil && err != io.EOF {
+		w.err, w.buf = err, w.buf[:0]
+		return nil
+	}
+	w.base = offset
+
+	return w.buf[:end-offset]
+}
+
+// decodeValidRecord 解码 offset 处的记录，批次必须包含完整的提交标记，只返回记录的元数据
+func (w *regionWindow) decodeValidRecord(offset int64, aead cipher.AEAD) (*validRecord, error) {
+	h, err := parseHeader(w.slice(offset, recordHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	seg, err := decodeRecord(w.slice(offset, h.recordSize()), aead)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := unpackRecord(offset, seg, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &validRecord{start: offset, end: offset + int64(seg.recordSize()), entries: make([]recordMeta, 0, len(entries))}
+	for _, entry := range entries {
+		rec.entries = append(rec.entries, recordMeta{
+			key:       entry.seg.key,
+			offset:    entry.offset,
+			length:    uint32(entry.seg.recordSize()),
+			createdAt: entry.seg.createdAt,
+		})
+	}
+
+	return rec, nil
+}
+
+// nextCandidate 返回从 offset 开始第一个记录头部合法并且记录没有超出文件末尾的偏移量，没有时返回文件大小。
+// 损坏的数据中只有这些位置才需要校验 Checksum，不需要在每个字节处完整解码
+func (w *regionWindow) nextCandidate(offset int64) int64 {
+	for ; offset+recordHeaderSize <= w.size; offset++ {
+		buf := w.slice(offset, recordHeaderSize)
+		if len(buf) < recordHeaderSize {
+			break
+		}
+		if buf[4] != recordVersion {
+			// 直接跳到窗口中下一个版本号可能出现的位置
+			rest := w.buf[offset+5-w.base:]
+			if i := bytes.IndexByte(rest, recordVersion); i >= 0 {
+				offset += int64(i)
+			} else {
+				offset += int64(len(rest))
+			}
+			continue
+		}
+		if h, err := parseHeader(buf); err == nil && offset+int64(h.recordSize()) <= w.size {
+			return offset
+		}
+	}
+	return w.size
+}
+
+// readValidRecord 重新读取校验通过的记录，返回展开之后的完整记录
+func readValidRecord(file File, rec validRecord, aead cipher.AEAD) ([]batchEntry, error) {
+	buf := make([]byte, rec.end-rec.start)
+	if _, err := file.ReadAt(buf, rec.start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	seg, err := decodeRecord(buf, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	return unpackRecord(rec.start, seg, aead)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// damagedRecordKey 从损坏的记录中读取 key 和时间戳，只有记录头部和 key 完整并且没有加密时才能识别
+func damagedRecordKey(buf []byte) (string, int64, bool) {
+	h, err := parseHeader(buf)
+	if err != nil || h.flags&(flagEncrypted|flagBatch) != 0 || h.keySize == 0 {
+		return "", 0, false
+	}
+	end := recordHeaderSize + int(h.keySize)
+	if end > len(buf) || h.createdAt <= 0 || h.createdAt > time.Now().UnixNano() {
+		return "", 0, false
+	}
+	return string(buf[recordHeaderSize:end]), h.createdAt, true
+}
+
+func allZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// danglingEntries 返回索引快照中引用的记录不存在或者已经损坏的 key
+func danglingEntries(snap *indexSnapshot, scans map[uint16]*regionScan) []string {
+	valid := make(map[uint16]map[int64]uint32, len(scans))
+	for id, scan := range scans {
+		offsets := make(map[int64]uint32)
+		for _, rec := range scan.records {
+			for _, entry := range rec.entries {
+				offsets[entry.offset] = entry.length
+			}
+		}
+		valid[id] = offsets
+	}
+
+	dangling := make([]string, 0)
+	for key, inode := range snap.entries {
+		if length, ok := valid[inode.RegionID][int64(inode.Offset)]; !ok || length != inode.Length {
+			dangling = append(dangling, key)
+		}
+	}
+	sort.Strings(dangling)
+
+	return dangling
+}
+
+// lostKeys 返回最新的记录已经损坏的 key 和这条记录的时间戳。索引快照中悬空的条目给出准确的时间戳，
+// 其他损坏的记录只能从没有损坏的记录头部识别，没有更新的有效记录的 key 才算丢失
+func lostKeys(snap *indexSnapshot, dangling []string, scans map[uint16]*regionScan) map[string]int64 {
+	candidates := make(map[string]int64)
+	for _, key := range dangling {
+		candidates[key] = snap.entries[key].CreatedTime.UnixNano()
+	}
+	for _, scan := range scans {
+		for key, createdAt := range scan.damaged {
+			if createdAt > candidates[key] {
+				candidates[key] = createdAt
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return candidates
+	}
+
+	for _, scan := range scans {
+		for _, rec := range scan.records {
+			for _, entry := range rec.entries {
+				if createdAt, ok := candidates[entry.key]; ok && entry.createdAt >= createdAt {
+					delete(candidates, entry.key)
+				}
+			}
+		}
+	}
+
+	return candidates
+}
+
+// repairRegions 将损坏的数据文件中校验通过的记录复制到新的数据文件并替换原文件
+func repairRegions(fsys FileSystem, path string, report *CheckReport, scans map[uint16]*regionScan) error {
+	for _, region := range report.Regions {
+		scan := scans[region.ID]
+		if region.healthy() {
+			continue
+		}
+		if err := repairRegion(fsys, path, scan); err != nil {
+			return fmt.Errorf("failed to repair region %d: %w", scan.report.ID, err)
+		}
+		report.Repaired = append(report.Repaired, scan.report.ID)
+	}
+
+	// 清理崩溃残留的临时文件，修复之后的索引快照不再可信
+	for _, name := range report.Orphans {
+		if strings.HasSuffix(name, compactFileExtension) {
+			if err := fsys.Remove(filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(report.Repaired) > 0 || len(report.Dangling) > 0 || report.Snapshot != "" {
+		if err := fsys.Remove(filepath.Join(path, indexSnapshotFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return fsys.SyncDir(path)
+}
+
+// repairRegion 使用原来的文件头和校验通过的记录重写数据文件，原文件重命名为 .damaged 保留。
+// 文件头损坏或者缺少密钥的数据文件无法解析记录，只能整体隔离
+func repairRegion(fsys FileSystem, path string, scan *regionScan) error {
+	name := filepath.Join(path, regionFileName(scan.report.ID))
+
+	if scan.report.Error != "" {
+		clog.Warnf("Quarantining unreadable region %d: %s", scan.report.ID, scan.report.Error)
+		return fsys.Rename(name, name+damagedFileExtension)
+	}
+
+	src, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	// 重写的数据文件同时升级到当前格式，连续的有效记录合并为一段复制
+	header := scan.header
+	header.version = currentFormat
+	parts := []io.Reader{bytes.NewReader(header.bytes())}
+	var start, end int64
+	for _, rec := range scan.records {
+		if rec.start != end {
+			if end > start {
+				parts = append(parts, io.NewSectionReader(src, start, end-start))
+			}
+			start = rec.start
+		}
+		end = rec.end
+	}
+	if end > start {
+		parts = append(parts, io.NewSectionReader(src, start, end-start))
+	}
+
+	tmp := name + compactFileExtension
+	err = writeBackupFile(fsys, tmp, io.MultiReader(parts...))
+	src.Close()
+	if err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+
+	if err := fsys.Rename(name, name+damagedFileExtension); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	clog.Warnf("Repaired region %d, salvaged %d records and dropped %d corrupted bytes",
+		scan.report.ID, scan.report.Records, scan.report.CorruptedBytes())
+
+	return nil
+}
+
+// writeTombstones 为丢失的 key 追加使用原记录时间戳的删除标记，防止下一次完整扫描恢复更旧的记录。
+// 删除标记写入 findActiveRegion 会选择的活跃数据文件，没有这样的数据文件时使用空闲的 id 新建一个
+func writeTombstones(fsys FileSystem, path string, report *CheckReport, scans map[uint16]*regionScan, lost map[string]int64, kr *keyring) error {
+	if len(lost) == 0 {
+		return nil
+	}
+
+	var target, legacy *regionScan
+	for _, region := range report.Regions {
+		scan := scans[region.ID]
+		switch {
+		case region.Error != "" || scan.header.sealed:
+		case scan.header.version == legacyFormat:
+			legacy = scan
+		default:
+			target = scan
+		}
+	}
+	if target == nil {
+		target = legacy
+	}
+
+	header := newFileHeader(kr.activeID())
+	if target != nil {
+		header = target.header
+	}
+	aead, err := kr.aead(header.keyID)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, key := range report.Lost {
+		tombstone := &Segment{kind: Binary, flags: flagTombstone, key: key, createdAt: lost[key]}
+		record, err := encodeRecord(withEncryption(tombstone, aead), aead)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, record...)
+	}
+
+	if target == nil {
+		id, err := unusedRegionID(fsys, path, func(uint16) bool { return false })
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(path, regionFileName(id))
+		if err := writeBackupFile(fsys, name, bytes.NewReader(append(header.bytes(), buf...))); err != nil {
+			return err
+		}
+		clog.Warnf("Deleted %d lost keys in new region %d", len(lost), id)
+		return fsys.SyncDir(path)
+	}
+
+	// 数据文件中的有效记录是连续的，从最后一条有效记录之后写入，覆盖末尾的填充数据。
+	// 修复过的数据文件使用当前格式的文件头重写
+	if !target.report.healthy() {
+		header.version = currentFormat
+	}
+	end := header.size()
+	for _, rec := range target.records {
+		end += rec.end - rec.start
+	}
+
+	file, err := fsys.OpenFile(filepath.Join(path, regionFileName(target.report.ID)), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(end); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(buf, end); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	clog.Warnf("Deleted %d lost keys in region %d", len(lost), target.report.ID)
+
+	return nil
+}
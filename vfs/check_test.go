@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	for i := 0; i < 10; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Check(dir, nil); err == nil {
+		t.Error("Check() should fail while the directory is in use")
+	}
+
+	inode, _ := lfs.GetINode("key-3")
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || report.Regions[0].Records != 10 {
+		t.Fatalf("Check() = %+v, want a healthy directory with 10 records", report)
+	}
+
+	// 破坏 key-3 的 value 并放入无关的文件
+	name := filepath.Join(dir, regionFileName(inode.RegionID))
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int64(inode.Offset)
+	file.WriteAt([]byte("broken"), start+int64(inode.Length)-10)
+	file.Close()
+	os.WriteFile(filepath.Join(dir, "junk.txt"), nil, 0644)
+
+	report, err = Check(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	region := report.Regions[0]
+	if len(region.Corrupted) != 1 || region.Records != 9 {
+		t.Fatalf("region report = %+v, want one corrupted range and 9 records", region)
+	}
+	if c := region.Corrupted[0]; c.Start != start || c.End != start+int64(inode.Length) {
+		t.Errorf("corrupted range = [%d, %d), want [%d, %d)", c.Start, c.End, start, start+int64(inode.Length))
+	}
+	if fmt.Sprint(report.Dangling) != "[key-3]" || fmt.Sprint(report.Orphans) != "[junk.txt]" {
+		t.Errorf("dangling = %v, orphans = %v", report.Dangling, report.Orphans)
+	}
+
+	report, err = Repair(dir, nil)
+	if err != nil {
+		t.Fatalf("Repair() error: %v", err)
+	}
+	if fmt.Sprint(report.Repaired) != fmt.Sprint([]uint16{inode.RegionID}) {
+		t.Errorf("repaired regions = %v", report.Repaired)
+	}
+	if _, err := os.Stat(name + damagedFileExtension); err != nil {
+		t.Errorf("damaged region is not kept: %v", err)
+	}
+
+	// 修复保留的 .damaged 文件不是孤立文件
+	os.Remove(filepath.Join(dir, "junk.txt"))
+	report, err = Check(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || fmt.Sprint(report.Quarantined) != fmt.Sprint([]string{regionFileName(inode.RegionID) + damagedFileExtension}) {
+		t.Errorf("Check() after Repair() = %+v, want a healthy directory with one quarantined region", report)
+	}
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	for i := 0; i < 10; i++ {
+		_, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if (err == nil) == (i == 3) {
+			t.Errorf("FetchSegment(key-%d) error: %v", i, err)
+		}
+	}
+}
+
+func TestRepair_LostKeys(t *testing.T) {
+	for _, snapshot := range []bool{true, false} {
+		dir := t.TempDir()
+		lfs := openTestFS(t, dir)
+
+		// OLD 位于封存的数据文件中，最新的 NEW 在活跃数据文件中损坏
+		if err := lfs.PutSegment("key", newTestSegment("OLD")); err != nil {
+			t.Fatal(err)
+		}
+		lfs.mu.Lock()
+		if err := lfs.rotateRegion(); err != nil {
+			t.Fatal(err)
+		}
+		lfs.mu.Unlock()
+		if err := lfs.PutSegment("key", newTestSegment("NEW")); err != nil {
+			t.Fatal(err)
+		}
+		if err := lfs.PutSegment("other", newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+		inode, _ := lfs.GetINode("key")
+		if err := lfs.CloseFS(); err != nil {
+			t.Fatal(err)
+		}
+		if !snapshot {
+			os.Remove(filepath.Join(dir, indexSnapshotFile))
+		}
+
+		file, err := os.OpenFile(filepath.Join(dir, regionFileName(inode.RegionID)), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt([]byte{0xFF}, int64(inode.Offset)+int64(inode.Length)-1)
+		file.Close()
+
+		report, err := Check(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(report.Lost) != "[key]" {
+			t.Errorf("Check() lost = %v with snapshot %v, want [key]", report.Lost, snapshot)
+		}
+
+		if _, err := Repair(dir, nil); err != nil {
+			t.Fatalf("Repair() error: %v", err)
+		}
+		if report, err := Check(dir, nil); err != nil || !report.Healthy() || len(report.Lost) != 0 {
+			t.Errorf("Check() after Repair() = %+v, %v", report, err)
+		}
+
+		// 修复之后的完整扫描不能恢复更旧的记录
+		lfs = openTestFS(t, dir)
+		if seg, err := lfs.FetchSegment("key"); err != ErrSegmentNotFound {
+			t.Errorf("FetchSegment(key) = %v, %v with snapshot %v, want %v", seg, err, snapshot, ErrSegmentNotFound)
+		}
+		if _, err := lfs.FetchSegment("other"); err != nil {
+			t.Errorf("FetchSegment(other) error: %v", err)
+		}
+		if err := lfs.PutSegment("key", newTestSegment("LATEST")); err != nil {
+			t.Fatal(err)
+		}
+		lfs.CloseFS()
+	}
+}
+
+func TestCheck_CorruptedSpan(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	inodes := make([]*INode, 30)
+	for i := range inodes {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(strings.Repeat("v", 100+i*10))); err != nil {
+			t.Fatal(err)
+		}
+		inodes[i], _ = lfs.GetINode(fmt.Sprintf("key-%d", i))
+	}
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 从 key-10 的开头到 key-19 的中间写入随机数据
+	start, end := int64(inodes[10].Offset), int64(inodes[19].Offset)+int64(inodes[19].Length)/2
+	garbage := make([]byte, end-start)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(inodes[0].RegionID)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(garbage, start)
+	file.Close()
+
+	want, err := Check(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	region := want.Regions[0]
+	if len(region.Corrupted) != 1 || region.Records != 20 {
+		t.Fatalf("region report = %+v, want one corrupted range and 20 records", region)
+	}
+	if c := region.Corrupted[0]; c.Start != start || c.End != int64(inodes[20].Offset) {
+		t.Errorf("corrupted range = [%d, %d), want [%d, %d)", c.Start, c.End, start, inodes[20].Offset)
+	}
+
+	// 窗口小于记录时结果不变
+	defer func(size int) { checkWindowSize = size }(checkWindowSize)
+	checkWindowSize = 64
+	got, err := Check(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Check() with a small window = %+v, want %+v", got.Regions[0], want.Regions[0])
+	}
+}
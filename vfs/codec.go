@@ -0,0 +1,177 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/auula/vasedb/conf"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression algorithm of a record value, saved in the record flags.
+type Codec uint8
+
+const (
+	// CodecNone stores the value as is
+	CodecNone Codec = iota
+	// CodecSnappy compresses the value with snappy
+	CodecSnappy
+	// CodecZstd compresses the value with zstd
+	CodecZstd
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// parseCodec 将配置中的压缩算法名称转换为 Codec
+func parseCodec(name string) (Codec, error) {
+	switch name {
+	case "", conf.CodecNone:
+		return CodecNone, nil
+	case conf.CodecSnappy:
+		return CodecSnappy, nil
+	case conf.CodecZstd:
+		return CodecZstd, nil
+	}
+	return CodecNone, fmt.Errorf("unsupported compression codec %q", name)
+}
+
+func (c Codec) valid() bool {
+	return c <= CodecZstd
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return conf.CodecNone
+	case CodecSnappy:
+		return conf.CodecSnappy
+	case CodecZstd:
+		return conf.CodecZstd
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// zstdCodec 延迟创建全局共享的 zstd 编码器和解码器，EncodeAll 和 DecodeAll 可以并发调用
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(maxValueSize),
+		)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func compressValue(c Codec, data []byte) []byte {
+	switch c {
+	case CodecSnappy:
+		return snappy.Encode(nil, data)
+	case CodecZstd:
+		enc, _ := zstdCodec()
+		return enc.EncodeAll(data, nil)
+	}
+	return data
+}
+
+func decompressValue(c Codec, data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxValueSize {
+			return nil, fmt.Errorf("decompressed size %d exceeds limit %d", size, maxValueSize)
+		}
+		return snappy.Decode(nil, data)
+	case CodecZstd:
+		_, dec := zstdCodec()
+		return dec.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidHeader, c)
+}
+
+// codec 返回记录中 value 使用的压缩算法
+func (s *Segment) codec() Codec {
+	return Codec(s.flags & flagCodecMask >> flagCodecShift)
+}
+
+// compressSegment 返回 value 被压缩之后的 Segment 副本，value 太小或者压缩之后没有变小时返回 seg 本身
+func (lfs *LogStructuredFS) compressSegment(seg *Segment) *Segment {
+	if lfs.codec == CodecNone || seg.isBatch() || seg.codec() != CodecNone || len(seg.data) < lfs.compressMinSize {
+		return seg
+	}
+
+	data := compressValue(lfs.codec, seg.data)
+	if len(data) >= len(seg.data) {
+		return seg
+	}
+
+	lfs.codecStats.records.Add(1)
+	lfs.codecStats.rawBytes.Add(uint64(len(seg.data)))
+	lfs.codecStats.storedBytes.Add(uint64(len(data)))
+
+	stored := *seg
+	stored.data = data
+	stored.flags |= uint8(lfs.codec) << flagCodecShift
+
+	return &stored
+}
+
+// decompressSegment 解压记录中的 value，返回的 Segment 不再带有压缩算法标记
+func decompressSegment(seg *Segment) (*Segment, error) {
+	c := seg.codec()
+	if c == CodecNone {
+		return seg, nil
+	}
+
+	data, err := decompressValue(c, seg.data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s value of key %q: %w", c, seg.key, err)
+	}
+
+	seg.data = data
+	seg.flags &^= flagCodecMask
+
+	return seg, nil
+}
+
+// codecStats 统计写入时被压缩的记录
+type codecStats struct {
+	records     atomic.Uint64
+	rawBytes    atomic.Uint64
+	storedBytes atomic.Uint64
+}
+
+// CompressionStat is the result of value compression since the file system was opened.
+type CompressionStat struct {
+	Codec       string  `json:"codec"`        // Configured codec of new records
+	Records     uint64  `json:"records"`      // Number of compressed records
+	RawBytes    uint64  `json:"raw_bytes"`    // Size of the values before compression
+	StoredBytes uint64  `json:"stored_bytes"` // Size of the values after compression
+	Ratio       float64 `json:"ratio"`        // StoredBytes / RawBytes, 1 when nothing was compressed
+}
+
+// CompressionStats returns the compression ratio of the values written since open.
+func (lfs *LogStructuredFS) CompressionStats() CompressionStat {
+	stat := CompressionStat{
+		Codec:       lfs.codec.String(),
+		Records:     lfs.codecStats.records.Load(),
+		RawBytes:    lfs.codecStats.rawBytes.Load(),
+		StoredBytes: lfs.codecStats.storedBytes.Load(),
+		Ratio:       1,
+	}
+	if stat.RawBytes > 0 {
+		stat.Ratio = float64(stat.StoredBytes) / float64(stat.RawBytes)
+	}
+	return stat
+}
@@ -0,0 +1,144 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+// openCodecFS 打开一个使用 codec 压缩 value 的实例
+func openCodecFS(t *testing.T, dir, codec string) *LogStructuredFS {
+	t.Helper()
+
+	opts := NewOptions(conf.Default)
+	opts.Codec = codec
+	opts.CompressMinSize = 64
+
+	return openTestFSWith(t, dir, opts)
+}
+
+func largeValue(i int) string {
+	return strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"vasedb"},`, i), 64)
+}
+
+func TestLogStructuredFS_Compression(t *testing.T) {
+	dir := t.TempDir()
+
+	// 不同的压缩算法写入同一个数据文件，每条记录都可以单独解压
+	for _, codec := range []string{conf.CodecZstd, conf.CodecSnappy, conf.CodecNone} {
+		lfs := openCodecFS(t, dir, codec)
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("%s-%d", codec, i)
+			if err := lfs.PutSegment(key, newTestSegment(largeValue(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lfs.PutSegment(codec+"-small", newTestSegment("small")); err != nil {
+			t.Fatal(err)
+		}
+
+		stat := lfs.CompressionStats()
+		if codec == conf.CodecNone {
+			if stat.Records != 0 || stat.Ratio != 1 {
+				t.Errorf("%s: CompressionStats() = %+v", codec, stat)
+			}
+		} else if stat.Records != 10 || stat.Ratio >= 0.5 {
+			t.Errorf("%s: CompressionStats() = %+v, want 10 records with ratio below 0.5", codec, stat)
+		}
+
+		inode, _ := lfs.GetINode(codec + "-0")
+		if codec != conf.CodecNone && int(inode.Length) >= len(largeValue(0)) {
+			t.Errorf("%s: record length %d is not compressed", codec, inode.Length)
+		}
+
+		if err := lfs.CloseFS(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 全量扫描恢复索引之后依然可以读取所有记录
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+	lfs := openCodecFS(t, dir, conf.CodecNone)
+	defer lfs.CloseFS()
+
+	for _, codec := range []string{conf.CodecZstd, conf.CodecSnappy, conf.CodecNone} {
+		for i := 0; i < 10; i++ {
+			seg, err := lfs.FetchSegment(fmt.Sprintf("%s-%d", codec, i))
+			if err != nil {
+				t.Fatalf("FetchSegment(%s-%d) error: %v", codec, i, err)
+			}
+			if string(seg.data) != largeValue(i) || seg.codec() != CodecNone {
+				t.Errorf("FetchSegment(%s-%d) returned a wrong value", codec, i)
+			}
+		}
+		seg, err := lfs.FetchSegment(codec + "-small")
+		if err != nil || string(seg.data) != "small" {
+			t.Errorf("FetchSegment(%s-small) = %v, %v", codec, seg, err)
+		}
+	}
+}
+
+func TestLogStructuredFS_CompressionCompact(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openCodecFS(t, dir, conf.CodecZstd)
+	lfs.regionThreshold = 1024
+
+	for round := 0; round < 5; round++ {
+		wb := NewWriteBatch()
+		for i := 0; i < 4; i++ {
+			wb.Put(fmt.Sprintf("key-%d", i), newTestSegment(largeValue(round*10+i)))
+		}
+		if err := lfs.BatchINodes(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+	if err := lfs.ExpireSegment("key-0", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	crashTestFS(lfs)
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+	lfs = openCodecFS(t, dir, conf.CodecSnappy)
+	defer lfs.CloseFS()
+
+	for i := 0; i < 4; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("FetchSegment(key-%d) error: %v", i, err)
+		}
+		if string(seg.data) != largeValue(40+i) {
+			t.Errorf("FetchSegment(key-%d) returned a wrong value", i)
+		}
+	}
+}
+
+func TestParseHeader_UnknownCodec(t *testing.T) {
+	seg := newTestSegment("value")
+	seg.key = "key"
+	seg.flags = 3 << flagCodecShift
+
+	buf, err := encodeSegment(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeSegment(buf); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("decodeSegment() = %v, want %v", err, ErrInvalidHeader)
+	}
+}
+
+func TestOptions_Codec(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.Codec = "lz4"
+	if err := opts.validate(); err == nil {
+		t.Error("validate() should reject unknown codec")
+	}
+}
@@ -1,7 +1,424 @@
 package vfs
 
-import "os"
+import (
+	"bufio"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+var (
+	// 数据压缩时生成的临时文件扩展名，完成之后重命名为正式的数据文件
+	compactFileExtension = ".tmp"
+	// 默认垃圾数据占比阈值
+	defaultGarbageThreshold = 0.5
+)
+
+// regionStat 记录数据文件中的记录大小和已经失效的垃圾数据大小
+type regionStat struct {
+	size       int64 // Total bytes of records
+	garbage    int64 // Bytes of records which are no longer referenced
+	minCreated int64 // Oldest record timestamp, 0 when unknown
+}
+
+func (s *regionStat) ratio() float64 {
+	if s.size == 0 {
+		return 0
+	}
+	return float64(s.garbage) / float64(s.size)
+}
+
+// relocation 记录数据压缩时一条存活记录的新旧位置
+type relocation struct {
+	key    string
+	offset uint32
+	inode  *INode
+}
+
+// Compressor reclaims disk space of sealed regions whose garbage
+// ratio exceeds the threshold by copying live records into a fresh region.
 type Compressor struct {
-	DirtyReginos []*os.File
+	lfs       *LogStructuredFS
+	threshold float64
+	mu        sync.Mutex // Serializes rewrites of compaction and the scrubber
+}
+
+func newCompressor(lfs *LogStructuredFS, threshold float64) *Compressor {
+	if threshold <= 0 || threshold > 1 {
+		threshold = defaultGarbageThreshold
+	}
+	return &Compressor{lfs: lfs, threshold: threshold}
+}
+
+// DirtyRegions returns the sealed regions over the garbage threshold, dirtiest first,
+// and the regions which are not encrypted with the active key or are written in an older
+// file format, so compaction re-encrypts and upgrades them.
+// Regions pinned by a backup Snapshot are skipped until it is closed.
+func (c *Compressor) DirtyRegions() []uint16 {
+	lfs := c.lfs
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	ids := make([]uint16, 0)
+	for id := range lfs.regions {
+		stat, ok := lfs.stats[id]
+		if ok && lfs.pins[id] == 0 && (stat.ratio() >= c.threshold || lfs.outdatedRegion(id)) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return lfs.stats[ids[i]].ratio() > lfs.stats[ids[j]].ratio()
+	})
+
+	return ids
+}
+
+// Compact runs one garbage collection cycle over all dirty regions.
+func (c *Compressor) Compact() error {
+	ids := c.DirtyRegions()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, id := range ids {
+		select {
+		case <-c.lfs.closed:
+			return nil
+		default:
+		}
+
+		if err := c.compactRegion(id); err != nil {
+			return fmt.Errorf("failed to compact region %d: %w", id, err)
+		}
+	}
+
+	// 被回收的数据文件使旧的索引快照失效，重新保存一份
+	return c.lfs.saveIndexSnapshot()
+}
+
+// Upgrade rewrites every sealed region written in an older file format regardless of its
+// garbage ratio and returns the number of upgraded regions. Pinned regions are skipped.
+func (c *Compressor) Upgrade() (int, error) {
+	lfs := c.lfs
+
+	lfs.mu.RLock()
+	ids := make([]uint16, 0)
+	for id := range lfs.regions {
+		if lfs.regionHeaders[id].upgradable() {
+			ids = append(ids, id)
+		}
+	}
+	lfs.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	upgraded := 0
+	for _, id := range ids {
+		if err := c.compactRegion(id); err != nil {
+			return upgraded, fmt.Errorf("failed to upgrade region %d: %w", id, err)
+		}
+
+		lfs.mu.RLock()
+		_, exists := lfs.regions[id]
+		lfs.mu.RUnlock()
+		if !exists {
+			upgraded++
+		}
+	}
+
+	if upgraded == 0 {
+		return 0, nil
+	}
+	return upgraded, lfs.saveIndexSnapshot()
+}
+
+// compactRegion 将数据文件中的存活记录复制到新的数据文件，原子地替换索引之后删除旧文件
+func (c *Compressor) compactRegion(id uint16) error {
+	return c.rewriteRegion(id, nil)
+}
+
+// rewriteRegion 将数据文件中的存活记录复制到新的数据文件并替换索引。salvage 为 nil 时顺序扫描
+// 整个数据文件并删除旧文件，否则只复制 salvage 中校验通过的记录，旧文件被隔离保留，
+// 存活记录已经损坏的 key 追加删除标记并从索引中删除
+func (c *Compressor) rewriteRegion(id uint16, salvage *regionScan) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lfs := c.lfs
+
+	lfs.mu.Lock()
+	src, ok := lfs.regions[id]
+	if !ok || lfs.pins[id] > 0 {
+		lfs.mu.Unlock()
+		return nil
+	}
+	srcHeader, dstKey := lfs.regionHeaders[id], lfs.keyring.activeID()
+	newID, err := lfs.allocRegionID()
+	if err != nil {
+		lfs.mu.Unlock()
+		return err
+	}
+
+	// 持有写锁时创建临时文件，其他的分配不会再选择这个 id
+	path := filepath.Join(lfs.path, regionFileName(newID))
+	dst, err := lfs.fs.OpenFile(path+compactFileExtension, os.O_RDWR|os.O_CREATE|os.O_TRUNC, conf.FsPerm)
+	lfs.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to create compaction file: %w", err)
+	}
+
+	var (
+		moves []relocation
+		stat  *regionStat
+	)
+	if salvage == nil {
+		moves, stat, err = c.copyRecords(id, newID, src, dst, srcHeader, dstKey)
+	} else {
+		moves, stat, err = c.salvageRecords(id, newID, src, srcHeader, salvage, dst, dstKey)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		lfs.fs.Remove(path + compactFileExtension)
+		return err
+	}
+
+	var region File
+	if stat.size > 0 {
+		if err := lfs.fs.Rename(path+compactFileExtension, path); err != nil {
+			return fmt.Errorf("failed to rename compaction file: %w", err)
+		}
+		if err := lfs.fs.SyncDir(lfs.path); err != nil {
+			return err
+		}
+		region, err = lfs.fs.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open compacted region: %w", err)
+		}
+	} else {
+		// 没有存活的记录，直接删除旧文件即可
+		lfs.fs.Remove(path + compactFileExtension)
+	}
+
+	lfs.mu.Lock()
+	if region != nil {
+		lfs.regions[newID] = region
+		lfs.stats[newID] = stat
+		lfs.regionHeaders[newID] = newSealedHeader(dstKey)
+		lfs.mapRegion(newID, region)
+		for _, mv := range moves {
+			// 复制期间被覆盖写入的记录在新文件中也是垃圾数据
+			if !lfs.relocateINode(mv.key, id, mv.offset, mv.inode) {
+				stat.garbage += int64(mv.inode.Length)
+			}
+		}
+	}
+	var (
+		lost    int
+		lostErr error
+	)
+	if salvage != nil {
+		lost, lostErr = lfs.dropRegionINodes(id)
+	}
+	delete(lfs.regions, id)
+	delete(lfs.stats, id)
+	delete(lfs.regionHeaders, id)
+	if err := lfs.unmapRegion(id); err != nil {
+		clog.Warnf("Failed to unmap compacted region %d: %v", id, err)
+	}
+	lfs.mu.Unlock()
+
+	src.Close()
+
+	name := filepath.Join(lfs.path, regionFileName(id))
+	if salvage != nil {
+		// 删除标记持久化之前保留损坏的数据文件，下次打开时会因为损坏而失败，而不是恢复旧的记录
+		if lostErr != nil {
+			return lostErr
+		}
+		if _, err := lfs.syncActiveRegion(); err != nil {
+			return err
+		}
+		if err := lfs.fs.Rename(name, name+damagedFileExtension); err != nil {
+			return fmt.Errorf("failed to quarantine region: %w", err)
+		}
+		clog.Warnf("Quarantined region %d, salvaged %d live records into region %d and lost %d keys",
+			id, len(moves), newID, lost)
+		return lfs.fs.SyncDir(lfs.path)
+	}
+
+	if err := lfs.fs.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove compacted region: %w", err)
+	}
+
+	clog.Infof("Compacted region %d into region %d with %d live records", id, newID, len(moves))
+
+	return lfs.fs.SyncDir(lfs.path)
+}
+
+// copyRecords 顺序扫描数据文件，将存活的记录和仍然需要保留的删除标记写入 dst，
+// 使用 srcHeader 中的密钥解密并使用 dstKey 重新加密
+func (c *Compressor) copyRecords(id, newID uint16, src, dst File, srcHeader fileHeader, dstKey uint32) ([]relocation, *regionStat, error) {
+	srcAEAD, err := c.lfs.keyring.aead(srcHeader.keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAEAD, err := c.lfs.keyring.aead(dstKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := newSealedHeader(dstKey).bytes()
+	if _, err := dst.WriteAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+
+	headerSize := srcHeader.size()
+	reader := io.NewSectionReader(src, headerSize, math.MaxInt64-headerSize)
+	dec := NewDecoder(bufio.NewReader(reader))
+	dec.aead = srcAEAD
+	now := time.Now().UnixNano()
+
+	var moves []relocation
+	stat := new(regionStat)
+	srcOffset, dstOffset := headerSize, int64(len(header))
+
+	for {
+		seg, err := dec.Decode()
+		if err == io.EOF {
+			return moves, stat, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode region %d at offset %d: %w", id, srcOffset, err)
+		}
+
+		// 批次帧中的记录逐条复制，压缩之后不再需要保持原子性
+		entries, err := unpackRecord(srcOffset, seg, srcAEAD)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to unpack region %d at offset %d: %w", id, srcOffset, err)
+		}
+
+		for _, entry := range entries {
+			written, err := c.copyRecord(id, newID, entry, dst, dstOffset, dstAEAD, now, &moves, stat)
+			if err != nil {
+				return nil, nil, err
+			}
+			dstOffset += written
+		}
+
+		size := int64(seg.recordSize())
+		srcOffset += size
+	}
+}
+
+// salvageRecords 只复制数据文件中校验通过的记录，跳过损坏的字节范围
+func (c *Compressor) salvageRecords(id, newID uint16, src File, srcHeader fileHeader, scan *regionScan, dst File, dstKey uint32) ([]relocation, *regionStat, error) {
+	srcAEAD, err := c.lfs.keyring.aead(srcHeader.keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := c.lfs.keyring.aead(dstKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := newSealedHeader(dstKey).bytes()
+	if _, err := dst.WriteAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UnixNano()
+	var moves []relocation
+	stat := new(regionStat)
+	dstOffset := int64(len(header))
+
+	for _, rec := range scan.records {
+		entries, err := readValidRecord(src, rec, srcAEAD)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read salvaged record at offset %d: %w", rec.start, err)
+		}
+		for _, entry := range entries {
+			written, err := c.copyRecord(id, newID, entry, dst, dstOffset, aead, now, &moves, stat)
+			if err != nil {
+				return nil, nil, err
+			}
+			dstOffset += written
+		}
+	}
+
+	return moves, stat, nil
+}
+
+// copyRecord 将仍然需要保留的记录写入 dst 的 dstOffset 处，返回写入的字节数
+func (c *Compressor) copyRecord(id, newID uint16, entry batchEntry, dst File, dstOffset int64, aead cipher.AEAD, now int64, moves *[]relocation, stat *regionStat) (int64, error) {
+	seg := entry.seg
+	deletion := seg.IsTombstone() || seg.expired(now)
+
+	if deletion && c.canDropDeletion(id, seg.createdAt) || !deletion && !c.isLive(id, entry.offset, seg) {
+		return 0, nil
+	}
+
+	seg = withEncryption(seg, aead)
+	record, err := encodeRecord(seg, aead)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dst.WriteAt(record, dstOffset); err != nil {
+		return 0, err
+	}
+
+	if !deletion {
+		*moves = append(*moves, relocation{
+			key:    seg.key,
+			offset: uint32(entry.offset),
+			inode:  newINode(newID, dstOffset, seg),
+		})
+	}
+
+	size := int64(len(record))
+	if stat.minCreated == 0 || seg.createdAt < stat.minCreated {
+		stat.minCreated = seg.createdAt
+	}
+	stat.size += size
+
+	return size, nil
+}
+
+// canDropDeletion 判断删除标记或者过期记录是否可以丢弃，只有当其他数据文件中
+// 不存在比它更旧的记录时，丢弃之后恢复索引才不会让旧记录重新生效
+func (c *Compressor) canDropDeletion(id uint16, createdAt int64) bool {
+	lfs := c.lfs
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	for rid, stat := range lfs.stats {
+		if rid == id || stat.size == 0 {
+			continue
+		}
+		// minCreated 未知时保守地认为存在更旧的记录
+		if stat.minCreated == 0 || stat.minCreated <= createdAt {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isLive 判断记录是否仍然被索引引用
+func (c *Compressor) isLive(id uint16, offset int64, seg *Segment) bool {
+	inode, ok := c.lfs.GetINode(seg.key)
+	return ok && inode.RegionID == id && inode.Offset == uint32(offset)
 }
@@ -0,0 +1,199 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressor_Compact(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 256
+
+	// 反复覆盖写入同一批 key，旧的数据文件中大部分都是垃圾数据
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 4; i++ {
+			err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(fmt.Sprintf("value-%d-%d", i, round)))
+			if err != nil {
+				t.Fatalf("PutSegment() error: %v", err)
+			}
+		}
+	}
+
+	dirty := lfs.compressor.DirtyRegions()
+	if len(dirty) == 0 {
+		t.Fatal("DirtyRegions() returned no regions")
+	}
+
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+
+	for _, id := range dirty {
+		if _, err := os.Stat(filepath.Join(dir, regionFileName(id))); !os.IsNotExist(err) {
+			t.Errorf("region %d should be removed after compaction", id)
+		}
+	}
+
+	if left := lfs.compressor.DirtyRegions(); len(left) != 0 {
+		t.Errorf("DirtyRegions() after Compact() = %v", left)
+	}
+
+	check := func(lfs *LogStructuredFS) {
+		for i := 0; i < 4; i++ {
+			seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+			if err != nil {
+				t.Fatalf("FetchSegment(key-%d) error: %v", i, err)
+			}
+			if want := fmt.Sprintf("value-%d-4", i); string(seg.data) != want {
+				t.Errorf("FetchSegment(key-%d) = %s, want %s", i, seg.data, want)
+			}
+		}
+	}
+
+	check(lfs)
+
+	// 压缩之后的数据文件同样可以通过全量扫描恢复
+	crashTestFS(lfs)
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	check(lfs)
+}
+
+func TestCompressor_ConcurrentOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	// 第一个数据文件容纳 4 条记录，其中一半是垃圾数据
+	record := newTestSegment("old")
+	record.key = "key-0"
+	lfs.regionThreshold = regionHeaderSize(0) + int64(4*record.recordSize())
+
+	for _, key := range []string{"key-0", "key-0", "key-0", "key-1", "key-2"} {
+		if err := lfs.PutSegment(key, newTestSegment("old")); err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	dirty := lfs.compressor.DirtyRegions()
+	if len(dirty) != 1 {
+		t.Fatalf("DirtyRegions() = %v, want one region", dirty)
+	}
+
+	lfs.mu.RLock()
+	src := lfs.regions[dirty[0]]
+	lfs.mu.RUnlock()
+
+	dst, err := os.CreateTemp(dir, "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	moves, _, err := lfs.compressor.copyRecords(dirty[0], 99, src, dst, lfs.regionHeaders[dirty[0]], 0)
+	if err != nil {
+		t.Fatalf("copyRecords() error: %v", err)
+	}
+	if len(moves) != 2 {
+		t.Fatalf("copyRecords() moved %d records, want 2", len(moves))
+	}
+
+	// 复制完成之后 key 被覆盖写入，旧位置的记录不能替换新的索引
+	for _, key := range []string{"key-0", "key-1"} {
+		if err := lfs.PutSegment(key, newTestSegment("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, mv := range moves {
+		if lfs.relocateINode(mv.key, dirty[0], mv.offset, mv.inode) {
+			t.Error("relocateINode() replaced an overwritten INode")
+		}
+	}
+}
+
+// compactTestRegion 压缩数据文件 id 并返回数据压缩生成的数据文件 id，没有存活记录时返回 0
+func compactTestRegion(t *testing.T, lfs *LogStructuredFS, id uint16) uint16 {
+	t.Helper()
+
+	lfs.mu.RLock()
+	before := make(map[uint16]bool, len(lfs.regions))
+	for rid := range lfs.regions {
+		before[rid] = true
+	}
+	lfs.mu.RUnlock()
+
+	if err := lfs.compressor.compactRegion(id); err != nil {
+		t.Fatalf("compactRegion(%d) error: %v", id, err)
+	}
+
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	for rid := range lfs.regions {
+		if !before[rid] {
+			return rid
+		}
+	}
+	return 0
+}
+
+func TestCompressor_Tombstone(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	rotate := func() {
+		lfs.mu.Lock()
+		defer lfs.mu.Unlock()
+		if err := lfs.rotateRegion(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// region 1: hello, other
+	lfs.PutSegment("hello", newTestSegment("world"))
+	lfs.PutSegment("other", newTestSegment("old"))
+	rotate()
+
+	// region 2: 删除 hello，覆盖写入 other
+	lfs.DeleteSegment("hello")
+	lfs.PutSegment("other", newTestSegment("new"))
+	rotate()
+
+	// region 3: 活跃数据文件
+	lfs.PutSegment("latest", newTestSegment("value"))
+
+	// region 1 中还有 hello 的旧记录，删除标记必须保留
+	compacted := compactTestRegion(t, lfs, 2)
+	tombstone := &Segment{kind: Binary, flags: flagTombstone, key: "hello"}
+	if got := lfs.stats[compacted].size; got <= int64(tombstone.recordSize()) {
+		t.Fatalf("compacted region size = %d, tombstone was dropped", got)
+	}
+
+	compactTestRegion(t, lfs, 1)
+
+	// 更旧的数据文件已经不存在了，删除标记可以丢弃
+	compacted = compactTestRegion(t, lfs, compacted)
+
+	other := &Segment{kind: Text, key: "other", data: []byte("new")}
+	if got := lfs.stats[compacted].size; got != int64(other.recordSize()) {
+		t.Errorf("compacted region size = %d, want %d", got, other.recordSize())
+	}
+
+	crashTestFS(lfs)
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if _, err := lfs.FetchSegment("hello"); err != ErrSegmentNotFound {
+		t.Errorf("FetchSegment(hello) = %v, want %v", err, ErrSegmentNotFound)
+	}
+	if seg, err := lfs.FetchSegment("other"); err != nil || string(seg.data) != "new" {
+		t.Errorf("FetchSegment(other) = %v, %v", seg, err)
+	}
+}
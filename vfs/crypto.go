@@ -0,0 +1,217 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Encrypted record layout: Key 和 Value 作为一个整体使用 AES-GCM 加密，磁盘上保存为
+//
+//	+-------+---------------------------------+-----+
+//	| Nonce | Ciphertext (KeySize+ValueSize)  | Tag |
+//	| 12    | ...                             | 16  |
+//	+-------+---------------------------------+-----+
+//
+// 记录头部不加密，作为附加数据参与认证，Checksum 覆盖的是密文。
+// 加密的数据文件和索引快照在文件头之后保存 4 字节的密钥 ID，密钥 ID 为 0 表示不加密。
+const (
+	gcmNonceSize = 12
+	sealOverhead = gcmNonceSize + 16
+	keyIDSize    = 4
+)
+
+var (
+	encryptedSnapshotMetadata = []byte{0xDB, 0x1D, 0x1, 0x2}
+
+	// ErrKeyNotFound is returned when data is encrypted with a key which is not in the key ring
+	ErrKeyNotFound = errors.New("encryption key not found")
+	// ErrEncryptionDisabled is returned when a record must be encrypted but no key is configured
+	ErrEncryptionDisabled = errors.New("encryption is disabled")
+	// ErrDecryptFailed is returned when an encrypted record or snapshot fails authentication
+	ErrDecryptFailed = errors.New("failed to decrypt")
+)
+
+// keyring 保存所有可用的密钥，ID 最大的密钥用于加密新的数据文件，其他密钥只用于解密
+type keyring struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+// parseKeyring 解析 <id>:<hex key> 格式的密钥列表，密钥之间使用换行或者逗号分隔，# 之后为注释。
+// 十六进制密钥的长度为 32、48 或者 64，分别对应 AES-128、AES-192 和 AES-256
+func parseKeyring(data string) (*keyring, error) {
+	kr := &keyring{aeads: make(map[uint32]cipher.AEAD)}
+
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			idText, keyText, ok := strings.Cut(entry, ":")
+			if !ok {
+				return nil, errors.New("encryption key must be in <id>:<hex key> format")
+			}
+			id, err := strconv.ParseUint(strings.TrimSpace(idText), 10, 32)
+			if err != nil || id == 0 {
+				return nil, fmt.Errorf("encryption key id %q must be a positive integer", idText)
+			}
+			if _, ok := kr.aeads[uint32(id)]; ok {
+				return nil, fmt.Errorf("duplicate encryption key id %d", id)
+			}
+
+			key, err := hex.DecodeString(strings.TrimSpace(keyText))
+			if err != nil {
+				return nil, fmt.Errorf("encryption key %d is not hex encoded: %w", id, err)
+			}
+			aead, err := newAEAD(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+			}
+
+			kr.aeads[uint32(id)] = aead
+			if uint32(id) > kr.active {
+				kr.active = uint32(id)
+			}
+		}
+	}
+
+	if len(kr.aeads) == 0 {
+		return nil, errors.New("no encryption key found")
+	}
+
+	return kr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKeyring 从环境变量或者密钥文件中加载密钥，环境变量优先
+func loadKeyring(file, env string) (*keyring, error) {
+	if env != "" {
+		if value := os.Getenv(env); value != "" {
+			return parseKeyring(value)
+		}
+	}
+	if file == "" {
+		return nil, fmt.Errorf("encryption key is not set in file or environment variable %s", env)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+
+	return parseKeyring(string(data))
+}
+
+// activeID 返回加密新数据使用的密钥 ID，没有开启加密时返回 0
+func (kr *keyring) activeID() uint32 {
+	if kr == nil {
+		return 0
+	}
+	return kr.active
+}
+
+// aead 返回密钥 ID 对应的 AEAD，密钥 ID 为 0 时返回 nil
+func (kr *keyring) aead(id uint32) (cipher.AEAD, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if kr != nil {
+		if aead, ok := kr.aeads[id]; ok {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key id %d", ErrKeyNotFound, id)
+}
+
+// isEncrypted reports whether the record of the segment is encrypted
+func (s *Segment) isEncrypted() bool {
+	return s.flags&flagEncrypted != 0
+}
+
+// withEncryption 返回加密标记与 aead 一致的 Segment，必要时复制一份，批次帧本身不加密
+func withEncryption(seg *Segment, aead cipher.AEAD) *Segment {
+	encrypted := aead != nil && !seg.isBatch()
+	if encrypted == seg.isEncrypted() {
+		return seg
+	}
+
+	stored := *seg
+	if encrypted {
+		stored.flags |= flagEncrypted
+	} else {
+		stored.flags &^= flagEncrypted
+	}
+
+	return &stored
+}
+
+// regionCipher 返回数据文件使用的 AEAD，不加密的数据文件返回 nil，调用者需要持有读锁或者写锁
+func (lfs *LogStructuredFS) regionCipher(id uint16) (cipher.AEAD, error) {
+	return lfs.keyring.aead(lfs.regionHeaders[id].keyID)
+}
+
+// sealSnapshot 使用活跃密钥加密索引快照
+func (lfs *LogStructuredFS) sealSnapshot(buf []byte) ([]byte, error) {
+	id := lfs.keyring.activeID()
+	if id == 0 {
+		return buf, nil
+	}
+	aead, err := lfs.keyring.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	header := binary.BigEndian.AppendUint32(append([]byte(nil), encryptedSnapshotMetadata...), id)
+	sealed := make([]byte, len(header)+gcmNonceSize, len(header)+sealOverhead+len(buf))
+	copy(sealed, header)
+	if _, err := rand.Read(sealed[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, sealed[len(header):], buf, header), nil
+}
+
+// openSnapshot 解密加密的索引快照，未加密的快照原样返回
+func openSnapshot(kr *keyring, buf []byte) ([]byte, error) {
+	headerSize := len(encryptedSnapshotMetadata) + keyIDSize
+	if !bytes.HasPrefix(buf, encryptedSnapshotMetadata) {
+		return buf, nil
+	}
+	if len(buf) < headerSize+sealOverhead {
+		return nil, errInvalidSnapshot
+	}
+
+	aead, err := kr.aead(binary.BigEndian.Uint32(buf[len(encryptedSnapshotMetadata):headerSize]))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := buf[headerSize : headerSize+gcmNonceSize]
+	plain, err := aead.Open(nil, nonce, buf[headerSize+gcmNonceSize:], buf[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("%w index snapshot: %v", ErrDecryptFailed, err)
+	}
+
+	return plain, nil
+}
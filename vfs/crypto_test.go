@@ -0,0 +1,184 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+const (
+	testKey1 = "1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+// openCryptoFS 打开一个使用环境变量中的密钥加密的实例
+func openCryptoFS(t *testing.T, dir, keys, mode string) (*LogStructuredFS, error) {
+	t.Helper()
+	t.Setenv("VASEDB_TEST_KEY", keys)
+
+	opts := NewOptions(conf.Default)
+	opts.Mode = mode
+	opts.Encryption = true
+	opts.KeyEnv = "VASEDB_TEST_KEY"
+
+	return OpenFS(dir, opts)
+}
+
+func TestParseKeyring(t *testing.T) {
+	kr, err := parseKeyring("# keys\n" + testKey1 + "\n" + testKey2 + " # active\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kr.activeID() != 2 || len(kr.aeads) != 2 {
+		t.Errorf("parseKeyring() active = %d with %d keys", kr.activeID(), len(kr.aeads))
+	}
+
+	for _, data := range []string{
+		"",
+		"0:000102030405060708090a0b0c0d0e0f",
+		"1:0001",
+		"1:zz",
+		"000102030405060708090a0b0c0d0e0f",
+		testKey1 + "," + testKey1,
+	} {
+		if _, err := parseKeyring(data); err == nil {
+			t.Errorf("parseKeyring(%q) should fail", data)
+		}
+	}
+
+	if _, err := kr.aead(3); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("aead(3) = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestLogStructuredFS_Encryption(t *testing.T) {
+	for _, mode := range []string{conf.ModePread, conf.ModeMmap} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			lfs, err := openCryptoFS(t, dir, testKey1, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wb := NewWriteBatch()
+			for i := 0; i < 10; i++ {
+				wb.Put(fmt.Sprintf("secret-key-%d", i), newTestSegment(fmt.Sprintf("secret-value-%d", i)))
+			}
+			if err := lfs.BatchINodes(wb); err != nil {
+				t.Fatal(err)
+			}
+			if err := lfs.PutSegment("single", newTestSegment("secret-value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := lfs.CloseFS(); err != nil {
+				t.Fatal(err)
+			}
+
+			// 数据文件和索引快照中不能出现明文
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			for _, file := range files {
+				data, _ := os.ReadFile(file)
+				if bytes.Contains(data, []byte("secret")) {
+					t.Errorf("%s contains plaintext", filepath.Base(file))
+				}
+			}
+
+			// 加密的索引快照可以正常加载
+			lfs, err = openCryptoFS(t, dir, testKey1, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg, err := lfs.FetchSegment("single"); err != nil || string(seg.data) != "secret-value" {
+				t.Errorf("FetchSegment(single) = %v, %v", seg, err)
+			}
+			crashTestFS(lfs)
+
+			// 全量扫描恢复索引
+			os.Remove(filepath.Join(dir, indexSnapshotFile))
+			lfs, err = openCryptoFS(t, dir, testKey1, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lfs.CloseFS()
+
+			for i := 0; i < 10; i++ {
+				seg, err := lfs.FetchSegment(fmt.Sprintf("secret-key-%d", i))
+				if err != nil || string(seg.data) != fmt.Sprintf("secret-value-%d", i) {
+					t.Errorf("FetchSegment(secret-key-%d) = %v, %v", i, seg, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLogStructuredFS_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	lfs, err := openCryptoFS(t, dir, testKey1, conf.ModePread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缺少数据文件使用的密钥时无法打开
+	if _, err := openCryptoFS(t, dir, testKey2, conf.ModePread); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("OpenFS() without key 1 = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// 新的密钥只用于新的数据文件，压缩之后旧的数据文件使用新的密钥重新加密
+	lfs, err = openCryptoFS(t, dir, testKey1+"\n"+testKey2, conf.ModePread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := lfs.regionHeaders[lfs.regionID].keyID; key != 2 {
+		t.Errorf("active region key = %d, want 2", key)
+	}
+	if err := lfs.PutSegment("key-new", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+	for id, header := range lfs.regionHeaders {
+		if header.keyID != 2 {
+			t.Errorf("region %d is encrypted with key %d after compaction", id, header.keyID)
+		}
+	}
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧的密钥不再被使用之后可以移除
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+	lfs, err = openCryptoFS(t, dir, testKey2, conf.ModePread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfs.CloseFS()
+
+	for _, key := range []string{"key-0", "key-9", "key-new"} {
+		if seg, err := lfs.FetchSegment(key); err != nil || string(seg.data) != "value" {
+			t.Errorf("FetchSegment(%s) = %v, %v", key, seg, err)
+		}
+	}
+}
+
+func TestOptions_Encryption(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.Encryption = true
+	opts.KeyEnv = ""
+	if err := opts.validate(); err == nil {
+		t.Error("validate() should reject encryption without keys")
+	}
+}
@@ -0,0 +1,165 @@
+package vfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/auula/vasedb/clog"
+)
+
+const (
+	// O_DIRECT 要求写入的内存地址、偏移量和长度都按照块大小对齐
+	directBlockSize = 4096
+	// 缓冲池中缓冲区的大小，更大的写入单独分配
+	directBufferSize = 256 * directBlockSize
+)
+
+var directBuffers = sync.Pool{
+	New: func() any {
+		buf := alignedBuffer(directBufferSize)
+		return &buf
+	},
+}
+
+// alignedBuffer 分配内存地址按照块大小对齐的缓冲区
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directBlockSize)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directBlockSize - 1)); rem != 0 {
+		shift = directBlockSize - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (directBlockSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + directBlockSize - 1)
+}
+
+// directWriter 以 O_DIRECT 方式顺序追加活跃数据文件。最后一个不完整的块保存在内存中，
+// 每次写入都会连同新的记录重新写入这个块，并用 0 填充到块大小，文件末尾因此可能存在填充数据。
+type directWriter struct {
+	file File
+	base int64  // Offset of the last partial block
+	tail []byte // Contents of the last partial block
+}
+
+// newDirectWriter 创建从 offset 开始追加的 directWriter，读取 offset 所在块已有的数据
+func newDirectWriter(file File, reader File, offset int64) (*directWriter, error) {
+	w := &directWriter{
+		file: file,
+		base: alignDown(offset),
+		tail: make([]byte, offset-alignDown(offset), directBlockSize),
+	}
+
+	if _, err := reader.ReadAt(w.tail, w.base); err != nil {
+		return nil, fmt.Errorf("failed to read last block: %w", err)
+	}
+
+	return w, nil
+}
+
+// WriteAt 追加 p 到文件末尾，off 必须是上一次写入之后的末尾偏移量
+func (w *directWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != w.base+int64(len(w.tail)) {
+		return 0, fmt.Errorf("non-sequential direct write at offset %d", off)
+	}
+
+	size := int(alignUp(int64(len(w.tail) + len(p))))
+
+	var buf []byte
+	if size <= directBufferSize {
+		pooled := directBuffers.Get().(*[]byte)
+		defer directBuffers.Put(pooled)
+		buf = (*pooled)[:size]
+	} else {
+		buf = alignedBuffer(size)
+	}
+
+	n := copy(buf, w.tail)
+	n += copy(buf[n:], p)
+	for i := n; i < size; i++ {
+		buf[i] = 0
+	}
+
+	if _, err := w.file.WriteAt(buf, w.base); err != nil {
+		return 0, err
+	}
+
+	end := off + int64(len(p))
+	base := alignDown(end)
+	w.tail = append(w.tail[:0], buf[base-w.base:end-w.base]...)
+	w.base = base
+
+	return len(p), nil
+}
+
+// close 截断末尾的填充数据并关闭文件
+func (w *directWriter) close() error {
+	err := w.file.Truncate(w.base + int64(len(w.tail)))
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openDirect 在 direct 模式下为活跃数据文件创建 O_DIRECT 写入，失败时回退到普通写入，调用者需要持有写锁
+func (lfs *LogStructuredFS) openDirect() {
+	if !lfs.directIO {
+		return
+	}
+
+	// O_DIRECT 只能用于操作系统的文件系统
+	if lfs.fs != OSFileSystem {
+		clog.Warnf("Falling back to buffered writes for region %d: O_DIRECT requires the OS file system", lfs.regionID)
+		return
+	}
+
+	path := filepath.Join(lfs.path, regionFileName(lfs.regionID))
+	file, err := openDirectFile(path)
+	if err == nil {
+		lfs.direct, err = newDirectWriter(file, lfs.activeRegion, lfs.offset)
+		if err != nil {
+			file.Close()
+		}
+	}
+
+	if err != nil {
+		clog.Warnf("Falling back to buffered writes for region %d: %v", lfs.regionID, err)
+		lfs.direct = nil
+	}
+}
+
+// closeDirect 关闭活跃数据文件的 O_DIRECT 写入，调用者需要持有写锁
+func (lfs *LogStructuredFS) closeDirect() error {
+	if lfs.direct == nil {
+		return nil
+	}
+
+	err := lfs.direct.close()
+	lfs.direct = nil
+	if err != nil {
+		return fmt.Errorf("failed to close direct writer: %w", err)
+	}
+	return nil
+}
+
+// isPadding 判断 offset 之后到文件末尾是否只有不足一个块的填充数据
+func isPadding(file File, offset int64) bool {
+	info, err := file.Stat()
+	if err != nil || info.Size()-offset >= directBlockSize {
+		return false
+	}
+
+	buf := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return false
+	}
+
+	return allZero(buf)
+}
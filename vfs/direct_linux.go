@@ -0,0 +1,13 @@
+//go:build linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile 以 O_DIRECT 方式打开数据文件，写入绕过页缓存
+func openDirectFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
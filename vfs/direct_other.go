@@ -0,0 +1,14 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+var errDirectUnsupported = errors.New("O_DIRECT is not supported on this platform")
+
+func openDirectFile(path string) (*os.File, error) {
+	return nil, errDirectUnsupported
+}
@@ -0,0 +1,103 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestDirectWriter_Padding(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "direct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(regionHeader(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newDirectWriter(file, file, regionHeaderSize(0))
+	if err != nil {
+		t.Fatalf("newDirectWriter() error: %v", err)
+	}
+
+	want := regionHeader(0)
+	for _, size := range []int{100, directBlockSize, 3*directBlockSize + 17, 1} {
+		p := bytes.Repeat([]byte{byte(size)}, size)
+		if _, err := w.WriteAt(p, int64(len(want))); err != nil {
+			t.Fatalf("WriteAt() error: %v", err)
+		}
+		want = append(want, p...)
+	}
+
+	if _, err := w.WriteAt([]byte("x"), 1); err == nil {
+		t.Error("WriteAt() should reject non-sequential writes")
+	}
+
+	// 文件按照块大小填充，填充部分全部为 0
+	info, _ := file.Stat()
+	if info.Size() != alignUp(int64(len(want))) {
+		t.Errorf("file size = %d, want %d", info.Size(), alignUp(int64(len(want))))
+	}
+	if !isPadding(file, int64(len(want))) {
+		t.Error("isPadding() = false, want true")
+	}
+
+	got, _ := os.ReadFile(file.Name())
+	if !bytes.Equal(got[:len(want)], want) {
+		t.Error("file contents do not match written data")
+	}
+}
+
+func TestDirectWriter_Recover(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.Mode = conf.ModeDirect
+
+	dir := t.TempDir()
+	lfs := openTestFSWith(t, dir, opts)
+	if lfs.direct == nil {
+		t.Skip("O_DIRECT is not supported by the temporary directory")
+	}
+	lfs.regionThreshold = 8 * 1024
+
+	for i := 0; i < 200; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i%50), newTestSegment(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	// 封存的数据文件没有填充数据
+	for id, file := range lfs.regions {
+		info, _ := file.Stat()
+		if size := info.Size() - regionHeaderSize(0); size != lfs.stats[id].size {
+			t.Errorf("region %d size = %d, want %d", id, size, lfs.stats[id].size)
+		}
+	}
+
+	activeID, offset := lfs.regionID, lfs.offset
+	crashTestFS(lfs)
+
+	lfs = openTestFSWith(t, dir, opts)
+	defer lfs.CloseFS()
+
+	if lfs.regionID != activeID || lfs.offset != offset {
+		t.Errorf("active region = %d@%d, want %d@%d", lfs.regionID, lfs.offset, activeID, offset)
+	}
+
+	for i := 150; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i%50)
+		seg, err := lfs.FetchSegment(key)
+		if err != nil {
+			t.Fatalf("FetchSegment(%s) error: %v", key, err)
+		}
+		if want := fmt.Sprintf("value-%d", i); string(seg.data) != want {
+			t.Errorf("FetchSegment(%s) = %s, want %s", key, seg.data, want)
+		}
+	}
+}
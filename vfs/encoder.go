@@ -1,4 +1,280 @@
 package vfs
 
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Record layout (version 1), all integers are big-endian:
+//
+//	+----------+---------+------+-------+---------+-----------+-----------+-----------+-----+-------+
+//	| Checksum | Version | Kind | Flags | KeySize | ValueSize | CreatedAt | ExpiredAt | Key | Value |
+//	| 4 bytes  | 1 byte  | 1    | 1     | 4       | 4         | 8         | 8         | ... | ...   |
+//	+----------+---------+------+-------+---------+-----------+-----------+-----------+-----+-------+
+//
+// Checksum 是 CRC32-C，覆盖 Checksum 之后的全部字节（包括 Key 和 Value）。
+// CreatedAt 和 ExpiredAt 为 Unix 纳秒时间戳，ExpiredAt 为 0 表示永不过期。
+// Flags 的第 2 到 3 位是 Value 的压缩算法，ValueSize 是压缩之后的大小。
+// Flags 的第 4 位表示 Key 和 Value 被加密，加密记录的布局见 crypto.go。
+const (
+	recordVersion    uint8 = 1
+	recordHeaderSize       = 31
+	maxKeySize             = 1<<16 - 1
+	maxValueSize           = 1 << 30
+)
+
+const (
+	// flagTombstone marks a record which deletes its key
+	flagTombstone uint8 = 1 << iota
+	// flagBatch marks a frame which holds the records of a write batch
+	flagBatch
+)
+
+const (
+	flagCodecShift       = 2
+	flagCodecMask  uint8 = 3 << flagCodecShift
+	// flagEncrypted marks a record whose key and value are sealed with AES-GCM
+	flagEncrypted uint8 = 1 << 4
+)
+
+var (
+	crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrChecksumMismatch is returned when a record fails CRC verification
+	ErrChecksumMismatch = errors.New("record checksum mismatch")
+	// ErrTruncatedRecord is returned when a record ends before its declared size
+	ErrTruncatedRecord = errors.New("record is truncated")
+	// ErrInvalidHeader is returned when a record header contains illegal fields
+	ErrInvalidHeader = errors.New("invalid record header")
+)
+
+// isCorrupted 判断错误是否是由于记录数据损坏导致的
+func isCorrupted(err error) bool {
+	return errors.Is(err, ErrChecksumMismatch) ||
+		errors.Is(err, ErrTruncatedRecord) ||
+		errors.Is(err, ErrInvalidHeader)
+}
+
+type recordHeader struct {
+	checksum  uint32
+	version   uint8
+	kind      Kind
+	flags     uint8
+	keySize   uint32
+	valueSize uint32
+	createdAt int64
+	expiredAt int64
+}
+
+func (h *recordHeader) recordSize() int {
+	size := recordHeaderSize + int(h.keySize) + int(h.valueSize)
+	if h.flags&flagEncrypted != 0 {
+		size += sealOverhead
+	}
+	return size
+}
+
+func (h *recordHeader) marshal(buf []byte) {
+	binary.BigEndian.PutUint32(buf[0:4], h.checksum)
+	buf[4] = h.version
+	buf[5] = uint8(h.kind)
+	buf[6] = h.flags
+	binary.BigEndian.PutUint32(buf[7:11], h.keySize)
+	binary.BigEndian.PutUint32(buf[11:15], h.valueSize)
+	binary.BigEndian.PutUint64(buf[15:23], uint64(h.createdAt))
+	binary.BigEndian.PutUint64(buf[23:31], uint64(h.expiredAt))
+}
+
+// parseHeader 解析并校验记录头部，不校验 Checksum
+func parseHeader(buf []byte) (*recordHeader, error) {
+	if len(buf) < recordHeaderSize {
+		return nil, ErrTruncatedRecord
+	}
+
+	h := &recordHeader{
+		checksum:  binary.BigEndian.Uint32(buf[0:4]),
+		version:   buf[4],
+		kind:      Kind(buf[5]),
+		flags:     buf[6],
+		keySize:   binary.BigEndian.Uint32(buf[7:11]),
+		valueSize: binary.BigEndian.Uint32(buf[11:15]),
+		createdAt: int64(binary.BigEndian.Uint64(buf[15:23])),
+		expiredAt: int64(binary.BigEndian.Uint64(buf[23:31])),
+	}
+
+	if h.version != recordVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, h.version)
+	}
+	if !h.kind.valid() {
+		return nil, fmt.Errorf("%w: unknown kind %d", ErrInvalidHeader, h.kind)
+	}
+	if codec := Codec(h.flags & flagCodecMask >> flagCodecShift); !codec.valid() {
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidHeader, codec)
+	}
+	if h.keySize > maxKeySize || h.valueSize > maxValueSize {
+		return nil, fmt.Errorf("%w: key size %d value size %d", ErrInvalidHeader, h.keySize, h.valueSize)
+	}
+
+	return h, nil
+}
+
+// encodeSegment 将 Segment 编码为一条完整的不加密的磁盘记录
+func encodeSegment(seg *Segment) ([]byte, error) {
+	return encodeRecord(seg, nil)
+}
+
+// encodeRecord 将 Segment 编码为一条完整的磁盘记录，带有加密标记的 Segment 使用 aead 加密
+func encodeRecord(seg *Segment, aead cipher.AEAD) ([]byte, error) {
+	if len(seg.key) > maxKeySize {
+		return nil, fmt.Errorf("key size %d exceeds limit %d", len(seg.key), maxKeySize)
+	}
+	if len(seg.data) > maxValueSize {
+		return nil, fmt.Errorf("value size %d exceeds limit %d", len(seg.data), maxValueSize)
+	}
+
+	h := recordHeader{
+		version:   recordVersion,
+		kind:      seg.kind,
+		flags:     seg.flags,
+		keySize:   uint32(len(seg.key)),
+		valueSize: uint32(len(seg.data)),
+		createdAt: seg.createdAt,
+		expiredAt: seg.expiredAt,
+	}
+
+	buf := make([]byte, h.recordSize())
+	h.marshal(buf)
+
+	body := buf[recordHeaderSize:]
+	if seg.isEncrypted() {
+		if aead == nil {
+			return nil, fmt.Errorf("%w: record of key %q is marked encrypted", ErrEncryptionDisabled, seg.key)
+		}
+		plain := make([]byte, 0, len(seg.key)+len(seg.data))
+		plain = append(append(plain, seg.key...), seg.data...)
+		if _, err := rand.Read(body[:gcmNonceSize]); err != nil {
+			return nil, err
+		}
+		aead.Seal(body[gcmNonceSize:gcmNonceSize], body[:gcmNonceSize], plain, buf[4:recordHeaderSize])
+	} else {
+		copy(body, seg.key)
+		copy(body[len(seg.key):], seg.data)
+	}
+
+	// Checksum 覆盖除自身之外的所有字节
+	binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:], crc32Table))
+
+	return buf, nil
+}
+
+// decodeSegment 从一条完整的不加密的磁盘记录解码出 Segment
+func decodeSegment(buf []byte) (*Segment, error) {
+	return decodeRecord(buf, nil)
+}
+
+// decodeRecord 从一条完整的磁盘记录解码出 Segment，加密的记录使用 aead 解密，
+// 返回的 Segment 保留加密标记，recordSize 依然等于磁盘记录的长度
+func decodeRecord(buf []byte, aead cipher.AEAD) (*Segment, error) {
+	h, err := parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < h.recordSize() {
+		return nil, ErrTruncatedRecord
+	}
+
+	buf = buf[:h.recordSize()]
+	if crc32.Checksum(buf[4:], crc32Table) != h.checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	body := buf[recordHeaderSize:]
+	if h.flags&flagEncrypted != 0 {
+		if aead == nil {
+			return nil, fmt.Errorf("%w: record is encrypted", ErrKeyNotFound)
+		}
+		plain, err := aead.Open(nil, body[:gcmNonceSize], body[gcmNonceSize:], buf[4:recordHeaderSize])
+		if err != nil {
+			return nil, fmt.Errorf("%w record: %v", ErrDecryptFailed, err)
+		}
+		body = plain
+	}
+
+	seg := &Segment{
+		kind:      h.kind,
+		flags:     h.flags,
+		key:       string(body[:h.keySize]),
+		data:      make([]byte, h.valueSize),
+		createdAt: h.createdAt,
+		expiredAt: h.expiredAt,
+	}
+	copy(seg.data, body[h.keySize:])
+
+	return seg, nil
+}
+
+// Encoder writes encoded segment records to an output stream.
 type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the record of seg to the stream and returns the number of bytes written.
+func (enc *Encoder) Encode(seg *Segment) (int, error) {
+	buf, err := encodeSegment(seg)
+	if err != nil {
+		return 0, err
+	}
+	return enc.w.Write(buf)
+}
+
+// Decoder reads and verifies segment records from an input stream.
+type Decoder struct {
+	r      io.Reader
+	aead   cipher.AEAD // Decrypts encrypted records, nil for plain regions
+	header [recordHeaderSize]byte
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next record from the stream. It returns io.EOF
+// when the stream ends cleanly on a record boundary.
+func (dec *Decoder) Decode() (*Segment, error) {
+	_, err := io.ReadFull(dec.r, dec.header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedRecord
+		}
+		return nil, err
+	}
+
+	h, err := parseHeader(dec.header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, h.recordSize())
+	copy(buf, dec.header[:])
+	_, err = io.ReadFull(dec.r, buf[recordHeaderSize:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedRecord
+		}
+		return nil, err
+	}
+
+	return decodeRecord(buf, dec.aead)
 }
@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncoderDecoder_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	kinds := []Kind{Set, ZSet, List, Text, Tables, Binary, Number}
+	segs := make([]*Segment, 0, len(kinds)+1)
+
+	for _, kind := range kinds {
+		segs = append(segs, &Segment{
+			kind:      kind,
+			key:       "key-" + string(rune('a'+kind)),
+			data:      []byte(`{"value":"vasedb"}`),
+			createdAt: time.Now().UnixNano(),
+			expiredAt: time.Now().Add(time.Hour).UnixNano(),
+		})
+	}
+
+	// 删除标记没有 Value
+	segs = append(segs, &Segment{
+		kind:      Binary,
+		flags:     flagTombstone,
+		key:       "deleted",
+		data:      []byte{},
+		createdAt: time.Now().UnixNano(),
+	})
+
+	for _, seg := range segs {
+		n, err := enc.Encode(seg)
+		if err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		if n != recordHeaderSize+len(seg.key)+len(seg.data) {
+			t.Errorf("Encode() wrote %d bytes", n)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range segs {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Decode() = %+v, want %+v", got, want)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Decode() at end = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoder_Corrupted(t *testing.T) {
+	seg := &Segment{kind: Text, key: "key", data: []byte("value"), createdAt: 1}
+	record := seg.ToBytes()
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := NewDecoder(bytes.NewReader(record[:len(record)-1])).Decode()
+		if !errors.Is(err, ErrTruncatedRecord) {
+			t.Errorf("Decode() = %v, want %v", err, ErrTruncatedRecord)
+		}
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		broken := append([]byte(nil), record...)
+		broken[len(broken)-1] ^= 0xFF
+		_, err := NewDecoder(bytes.NewReader(broken)).Decode()
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Decode() = %v, want %v", err, ErrChecksumMismatch)
+		}
+	})
+}
+
+func TestEncodeRecord_EncryptionDisabled(t *testing.T) {
+	seg := &Segment{kind: Text, flags: flagEncrypted, key: "key", data: []byte("value")}
+
+	_, err := encodeRecord(seg, nil)
+	if !errors.Is(err, ErrEncryptionDisabled) {
+		t.Errorf("encodeRecord() = %v, want %v", err, ErrEncryptionDisabled)
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("encodeRecord() = %v, should not be %v", err, ErrKeyNotFound)
+	}
+}
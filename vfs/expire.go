@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"time"
+)
+
+// NoExpiration is returned by TTL for segments which never expire.
+const NoExpiration time.Duration = -1
+
+var (
+	// 后台主动过期扫描的时间间隔
+	expireInterval = time.Second
+	// 每个索引分片每轮抽样检查的 INode 数量
+	expireSamples = 20
+	// 抽样中过期的比例超过该值时继续扫描当前分片
+	expireRepeatRatio = 0.25
+)
+
+// isExpired 判断 INode 在 now 时刻是否已经过期
+func (inode *INode) isExpired(now time.Time) bool {
+	return !inode.EexpireTime.IsZero() && !now.Before(inode.EexpireTime)
+}
+
+// TTL returns the remaining time to live of the segment stored under key.
+func (lfs *LogStructuredFS) TTL(key string) (time.Duration, error) {
+	inode, ok := lfs.GetINode(key)
+	if !ok {
+		return 0, ErrSegmentNotFound
+	}
+
+	now := time.Now()
+	if inode.isExpired(now) {
+		lfs.expireINode(key, inode)
+		return 0, ErrSegmentNotFound
+	}
+
+	if inode.EexpireTime.IsZero() {
+		return NoExpiration, nil
+	}
+
+	return inode.EexpireTime.Sub(now), nil
+}
+
+// ExpireSegment sets the time to live of the segment stored under key,
+// a non-positive ttl removes the expiration like PersistSegment.
+func (lfs *LogStructuredFS) ExpireSegment(key string, ttl time.Duration) error {
+	var expiredAt int64
+	if ttl > 0 {
+		expiredAt = time.Now().Add(ttl).UnixNano()
+	}
+	if err := lfs.rewriteExpiration(key, expiredAt); err != nil {
+		return err
+	}
+	return lfs.commitSync()
+}
+
+// PersistSegment removes the expiration of the segment stored under key.
+func (lfs *LogStructuredFS) PersistSegment(key string) error {
+	if err := lfs.rewriteExpiration(key, 0); err != nil {
+		return err
+	}
+	return lfs.commitSync()
+}
+
+// rewriteExpiration 以新的过期时间重新追加一条记录，保证重启之后依然生效
+func (lfs *LogStructuredFS) rewriteExpiration(key string, expiredAt int64) error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	inode, ok := lfs.GetINode(key)
+	if !ok || inode.isExpired(time.Now()) {
+		return ErrSegmentNotFound
+	}
+
+	seg, err := lfs.readRegion(key, inode)
+	if err != nil {
+		return err
+	}
+
+	seg.expiredAt = expiredAt
+	latest, err := lfs.appendSegment(seg)
+	if err != nil {
+		return err
+	}
+
+	if old := lfs.swapINode(key, latest); old != nil {
+		lfs.markGarbage(old)
+	}
+
+	return nil
+}
+
+// expireINode 仅当索引仍然指向 inode 时删除过期的索引，并计入垃圾数据
+func (lfs *LogStructuredFS) expireINode(key string, inode *INode) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	if lfs.removeINodeIf(key, inode) {
+		lfs.markGarbage(inode)
+	}
+}
+
+// sweepExpired 对每个索引分片抽样检查，主动删除已经过期的 INode
+func (lfs *LogStructuredFS) sweepExpired() error {
+	// 重新分片之后旧的分片不再被修改，删除时会在新的分片中检查
+	for _, shard := range lfs.index.Load().shards {
+		for {
+			now := time.Now()
+			sampled, expired := 0, make(map[string]*INode)
+
+			// map 的遍历顺序是随机的，可以作为随机抽样
+			shard.mux.RLock()
+			for key, inode := range shard.index {
+				if sampled >= expireSamples {
+					break
+				}
+				sampled++
+				if inode.isExpired(now) {
+					expired[key] = inode
+				}
+			}
+			shard.mux.RUnlock()
+
+			for key, inode := range expired {
+				lfs.expireINode(key, inode)
+			}
+
+			if sampled == 0 || float64(len(expired)) < float64(sampled)*expireRepeatRatio {
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLogStructuredFS_TTL(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	seg := newTestSegment("session")
+	seg.SetTTL(time.Hour)
+	if err := lfs.PutSegment("session", seg); err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+	if err := lfs.PutSegment("forever", newTestSegment("value")); err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	ttl, err := lfs.TTL("session")
+	if err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL(session) = %v, %v", ttl, err)
+	}
+
+	ttl, err = lfs.TTL("forever")
+	if err != nil || ttl != NoExpiration {
+		t.Errorf("TTL(forever) = %v, %v, want %v", ttl, err, NoExpiration)
+	}
+
+	if _, err := lfs.TTL("missing"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("TTL(missing) = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	if err := lfs.PersistSegment("session"); err != nil {
+		t.Fatalf("PersistSegment() error: %v", err)
+	}
+	if err := lfs.ExpireSegment("forever", time.Minute); err != nil {
+		t.Fatalf("ExpireSegment() error: %v", err)
+	}
+
+	// 过期时间的修改在重启之后依然生效
+	crashTestFS(lfs)
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if ttl, _ := lfs.TTL("session"); ttl != NoExpiration {
+		t.Errorf("TTL(session) after restart = %v, want %v", ttl, NoExpiration)
+	}
+	if ttl, _ := lfs.TTL("forever"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL(forever) after restart = %v", ttl)
+	}
+
+	seg, err = lfs.FetchSegment("forever")
+	if err != nil || string(seg.data) != "value" {
+		t.Errorf("FetchSegment(forever) = %v, %v", seg, err)
+	}
+}
+
+func TestLogStructuredFS_LazyExpire(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	seg := newTestSegment("value")
+	seg.SetTTL(10 * time.Millisecond)
+	if err := lfs.PutSegment("hello", seg); err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := lfs.FetchSegment("hello"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+	if err := lfs.ExpireSegment("hello", time.Hour); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("ExpireSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	// 过期的记录在恢复时不会重新加入索引
+	crashTestFS(lfs)
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if _, ok := lfs.GetINode("hello"); ok {
+		t.Error("expired segment recovered into index")
+	}
+}
+
+func TestLogStructuredFS_SweepExpired(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	for i := 0; i < 100; i++ {
+		seg := newTestSegment("value")
+		if i%2 == 0 {
+			seg.SetTTL(time.Millisecond)
+		}
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), seg); err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	garbage := lfs.stats[lfs.regionID].garbage
+	if err := lfs.sweepExpired(); err != nil {
+		t.Fatalf("sweepExpired() error: %v", err)
+	}
+
+	if got := lfs.stats[lfs.regionID].garbage; got <= garbage {
+		t.Errorf("garbage after sweep = %d, want more than %d", got, garbage)
+	}
+
+	remain := 0
+	for _, shard := range lfs.index.Load().shards {
+		remain += len(shard.index)
+	}
+	if remain < 50 || remain == 100 {
+		t.Errorf("index size after sweep = %d", remain)
+	}
+}
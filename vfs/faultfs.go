@@ -0,0 +1,274 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FaultOp is a file operation which can be failed by FaultFileSystem.
+type FaultOp int
+
+const (
+	FaultOpen FaultOp = iota
+	FaultRead
+	FaultWrite
+	FaultSync
+	FaultTruncate
+	FaultRename
+	FaultRemove
+)
+
+// FaultRule fails matching operations of FaultFileSystem with EIO.
+type FaultRule struct {
+	Op    FaultOp // Operation to fail
+	Match string  // Suffix of the file name to match, empty matches all files
+	After int     // Number of matching operations to let through before failing
+	Torn  bool    // Write the first half of the data before failing a write
+}
+
+// FaultFileSystem wraps a FileSystem to inject I/O errors and torn writes,
+// and remembers unsynced writes so Crash can drop them like a power failure.
+type FaultFileSystem struct {
+	FileSystem
+
+	mu    sync.Mutex
+	rules []*FaultRule
+	undo  map[string][]undoRecord // Unsynced writes keyed by file name
+}
+
+// undoRecord 记录一次未持久化写入之前的文件内容，用于模拟崩溃时回滚
+type undoRecord struct {
+	offset int64
+	data   []byte
+	size   int64
+}
+
+// NewFaultFileSystem wraps fsys with fault injection.
+func NewFaultFileSystem(fsys FileSystem) *FaultFileSystem {
+	return &FaultFileSystem{
+		FileSystem: fsys,
+		undo:       make(map[string][]undoRecord),
+	}
+}
+
+// Inject adds a rule, the first matching rule is applied once and then removed.
+func (f *FaultFileSystem) Inject(rule FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, &rule)
+}
+
+// Reset removes all rules.
+func (f *FaultFileSystem) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+}
+
+// Crash rolls back every write which has not been synced, in reverse order.
+// Files must not be used after Crash, directory operations are not rolled back.
+func (f *FaultFileSystem) Crash() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for name, records := range f.undo {
+		file, err := f.FileSystem.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for i := len(records) - 1; i >= 0; i-- {
+			r := records[i]
+			if _, err := file.WriteAt(r.data, r.offset); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Truncate(r.size); err != nil {
+				file.Close()
+				return err
+			}
+		}
+
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	f.undo = make(map[string][]undoRecord)
+
+	return nil
+}
+
+// fault 返回匹配的规则，匹配的规则只会生效一次
+func (f *FaultFileSystem) fault(op FaultOp, name string) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, rule := range f.rules {
+		if rule.Op != op || !strings.HasSuffix(name, rule.Match) {
+			continue
+		}
+		if rule.After > 0 {
+			rule.After--
+			continue
+		}
+		f.rules = append(f.rules[:i], f.rules[i+1:]...)
+		return rule
+	}
+
+	return nil
+}
+
+func eio(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: syscall.EIO}
+}
+
+// record 在写入之前保存 [off, off+n) 原有的数据和文件大小
+func (f *FaultFileSystem) record(file File, off, n int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	r := undoRecord{offset: off, size: size}
+	if off < size {
+		end := off + n
+		if end > size {
+			end = size
+		}
+		r.data = make([]byte, end-off)
+		if _, err := file.ReadAt(r.data, off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	name := filepath.Clean(file.Name())
+	f.mu.Lock()
+	f.undo[name] = append(f.undo[name], r)
+	f.mu.Unlock()
+
+	return nil
+}
+
+func (f *FaultFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if f.fault(FaultOpen, name) != nil {
+		return nil, eio("open", name)
+	}
+
+	// 截断也是一次写入，需要记录原有的数据
+	file, err := f.FileSystem.OpenFile(name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	ff := &faultFile{File: file, fs: f}
+	if flag&os.O_TRUNC != 0 {
+		if err := ff.Truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return ff, nil
+}
+
+func (f *FaultFileSystem) Rename(oldpath, newpath string) error {
+	if f.fault(FaultRename, oldpath) != nil {
+		return eio("rename", oldpath)
+	}
+	if err := f.FileSystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if records, ok := f.undo[oldpath]; ok {
+		delete(f.undo, oldpath)
+		f.undo[newpath] = records
+	}
+
+	return nil
+}
+
+func (f *FaultFileSystem) Remove(name string) error {
+	if f.fault(FaultRemove, name) != nil {
+		return eio("remove", name)
+	}
+	if err := f.FileSystem.Remove(name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	delete(f.undo, filepath.Clean(name))
+	f.mu.Unlock()
+
+	return nil
+}
+
+type faultFile struct {
+	File
+	fs *FaultFileSystem
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fs.fault(FaultRead, f.Name()) != nil {
+		return 0, eio("read", f.Name())
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.record(f.File, off, int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	if rule := f.fs.fault(FaultWrite, f.Name()); rule != nil {
+		if rule.Torn {
+			n, _ := f.File.WriteAt(p[:len(p)/2], off)
+			return n, eio("write", f.Name())
+		}
+		return 0, eio("write", f.Name())
+	}
+
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if err := f.fs.record(f.File, size, info.Size()-size); err != nil {
+		return err
+	}
+
+	if f.fs.fault(FaultTruncate, f.Name()) != nil {
+		return eio("truncate", f.Name())
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if f.fs.fault(FaultSync, f.Name()) != nil {
+		return eio("sync", f.Name())
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	delete(f.fs.undo, filepath.Clean(f.Name()))
+	f.fs.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File is an open file of a FileSystem, *os.File satisfies it.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileSystem abstracts the file operations of the storage engine,
+// so recovery and compaction can run on top of in-memory or fault-injecting implementations.
+type FileSystem interface {
+	// OpenFile opens a file with the same flag semantics as os.OpenFile
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the sorted names of the regular files in the directory
+	ReadDir(path string) ([]string, error)
+	// SyncDir persists the directory entries, such as created and renamed files
+	SyncDir(path string) error
+	// Lock takes an exclusive lock of the file until the returned closer is closed
+	Lock(name string) (io.Closer, error)
+}
+
+// OSFileSystem is the default FileSystem backed by the operating system.
+var OSFileSystem FileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (osFS) SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// readFile 读取整个文件的内容
+func readFile(fsys FileSystem, name string) ([]byte, error) {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, info.Size())
+	if _, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// sortedNames 返回 dir 目录下的文件名称，用于内存文件系统
+func sortedNames(paths []string, dir string) []string {
+	dir = filepath.Clean(dir)
+	names := make([]string, 0)
+	for _, path := range paths {
+		if filepath.Dir(path) == dir {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,224 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+// openFaultFS 在内存文件系统上打开一个可以注入故障的实例
+func openFaultFS(t *testing.T, fsys *FaultFileSystem, sync string) *LogStructuredFS {
+	t.Helper()
+
+	opts := NewOptions(conf.Default)
+	opts.FileSystem = fsys
+	opts.Sync = sync
+
+	return openTestFSWith(t, "/data", opts)
+}
+
+func TestMemFileSystem(t *testing.T) {
+	fsys := NewMemFileSystem()
+	if err := fsys.MkdirAll("/data/sub", conf.FsPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fsys.OpenFile("/data/a", os.O_RDWR|os.O_CREATE|os.O_EXCL, conf.FsPerm)
+	if err != nil {
+		t.Fatalf("OpenFile() error: %v", err)
+	}
+	file.WriteAt([]byte("hello"), 0)
+	file.Close()
+
+	if _, err := fsys.OpenFile("/data/a", os.O_RDWR|os.O_CREATE|os.O_EXCL, conf.FsPerm); !os.IsExist(err) {
+		t.Errorf("OpenFile(O_EXCL) = %v, want exist error", err)
+	}
+	if _, err := fsys.OpenFile("/missing/a", os.O_RDWR|os.O_CREATE, conf.FsPerm); !os.IsNotExist(err) {
+		t.Errorf("OpenFile() in missing directory = %v, want not exist error", err)
+	}
+
+	if err := fsys.Rename("/data/a", "/data/b"); err != nil {
+		t.Fatalf("Rename() error: %v", err)
+	}
+	if names, _ := fsys.ReadDir("/data"); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("ReadDir() = %v, want [b]", names)
+	}
+	if buf, err := readFile(fsys, "/data/b"); err != nil || string(buf) != "hello" {
+		t.Errorf("readFile() = %q, %v", buf, err)
+	}
+
+	lock, err := fsys.Lock("/data/lock")
+	if err != nil {
+		t.Fatalf("Lock() error: %v", err)
+	}
+	if _, err := fsys.Lock("/data/lock"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Lock() = %v, want %v", err, ErrLocked)
+	}
+	lock.Close()
+}
+
+func TestFaultFileSystem_CrashDropsUnsynced(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+
+	lfs := openFaultFS(t, fsys, "os")
+	if err := lfs.PutSegment("synced", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lfs.syncActiveRegion(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lfs.PutSegment("unsynced", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	crashTestFS(lfs)
+	if err := fsys.Crash(); err != nil {
+		t.Fatalf("Crash() error: %v", err)
+	}
+
+	lfs = openFaultFS(t, fsys, "os")
+	defer lfs.CloseFS()
+
+	if _, err := lfs.FetchSegment("synced"); err != nil {
+		t.Errorf("FetchSegment(synced) error: %v", err)
+	}
+	if _, err := lfs.FetchSegment("unsynced"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(unsynced) = %v, want %v", err, ErrSegmentNotFound)
+	}
+}
+
+func TestFaultFileSystem_SyncAlways(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+
+	lfs := openFaultFS(t, fsys, "always")
+	lfs.regionThreshold = 256
+	for i := 0; i < 20; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 同步失败的写入不能返回成功
+	fsys.Inject(FaultRule{Op: FaultSync})
+	if err := lfs.PutSegment("failed", newTestSegment("value")); !errors.Is(err, syscall.EIO) {
+		t.Errorf("PutSegment() = %v, want EIO", err)
+	}
+
+	crashTestFS(lfs)
+	fsys.Crash()
+
+	lfs = openFaultFS(t, fsys, "always")
+	defer lfs.CloseFS()
+
+	// 所有返回成功的写入在崩溃之后依然存在
+	for i := 0; i < 20; i++ {
+		if _, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) error: %v", i, err)
+		}
+	}
+}
+
+func TestFaultFileSystem_TornWrite(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+
+	lfs := openFaultFS(t, fsys, "always")
+	if err := lfs.PutSegment("hello", newTestSegment("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.Inject(FaultRule{Op: FaultWrite, Match: dataFileExtension, Torn: true})
+	if err := lfs.PutSegment("torn", newTestSegment("value")); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("PutSegment() = %v, want EIO", err)
+	}
+
+	// 写入失败不会推进偏移量，下一次写入覆盖不完整的记录
+	if err := lfs.PutSegment("next", newTestSegment("value")); err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	crashTestFS(lfs)
+	fsys.Crash()
+
+	lfs = openFaultFS(t, fsys, "always")
+	defer lfs.CloseFS()
+
+	for _, key := range []string{"hello", "next"} {
+		if _, err := lfs.FetchSegment(key); err != nil {
+			t.Errorf("FetchSegment(%s) error: %v", key, err)
+		}
+	}
+	if _, err := lfs.FetchSegment("torn"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(torn) = %v, want %v", err, ErrSegmentNotFound)
+	}
+}
+
+func TestFaultFileSystem_CompactionFailure(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+
+	lfs := openFaultFS(t, fsys, "always")
+	lfs.regionThreshold = 256
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 4; i++ {
+			err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(fmt.Sprintf("value-%d-%d", i, round)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 压缩文件重命名失败，旧的数据文件保持不变
+	fsys.Inject(FaultRule{Op: FaultRename, Match: compactFileExtension})
+	if err := lfs.compressor.Compact(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Compact() = %v, want EIO", err)
+	}
+
+	crashTestFS(lfs)
+	fsys.Crash()
+
+	lfs = openFaultFS(t, fsys, "always")
+	defer lfs.CloseFS()
+
+	names, _ := fsys.ReadDir("/data")
+	for _, name := range names {
+		if filepath.Ext(name) == compactFileExtension {
+			t.Errorf("temporary file %s was not removed", name)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("FetchSegment(key-%d) error: %v", i, err)
+		}
+		if want := fmt.Sprintf("value-%d-4", i); string(seg.data) != want {
+			t.Errorf("FetchSegment(key-%d) = %s, want %s", i, seg.data, want)
+		}
+	}
+}
+
+func TestFaultFileSystem_CloseFailure(t *testing.T) {
+	fsys := NewFaultFileSystem(NewMemFileSystem())
+
+	lfs := openFaultFS(t, fsys, "always")
+	if err := lfs.PutSegment("key", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存索引快照失败时仍然释放数据文件和目录锁
+	fsys.Inject(FaultRule{Op: FaultWrite, Match: indexSnapshotFile + compactFileExtension})
+	if err := lfs.CloseFS(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("CloseFS() = %v, want %v", err, syscall.EIO)
+	}
+
+	lfs = openFaultFS(t, fsys, "always")
+	defer lfs.CloseFS()
+	if _, err := lfs.FetchSegment("key"); err != nil {
+		t.Errorf("FetchSegment(key) after failed close error: %v", err)
+	}
+}
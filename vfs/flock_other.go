@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package vfs
+
+import "os"
+
+// lockFile 在不支持 flock 的平台上不做任何限制
+func lockFile(file *os.File) error {
+	return nil
+}
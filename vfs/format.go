@@ -0,0 +1,204 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Region header layout (format 2.x), all integers are big-endian:
+//
+//	+-------+-------+-------+-------+----------+-------+
+//	| Magic | Major | Minor | Flags | Reserved | KeyID |
+//	| 4     | 1     | 1     | 1     | 1        | 4     |
+//	+-------+-------+-------+-------+----------+-------+
+//
+// Magic 固定为 0xDB 'V' 'D' 'B'，KeyID 只在 Flags 的第 0 位为 1（加密）时存在。
+// Flags 的第 1 位表示数据文件已经封存，由数据压缩生成或者已经被滚动，不会再追加记录，恢复时不会被当作活跃数据文件。
+// 主版本不同的格式互不兼容，次版本只增加旧的读取者可以忽略的特性。
+// 格式 1.0 的文件头只有 4 个字节：不加密为 {0xDB,0,0,1}，加密为 {0xDB,0,1,1} 加上 KeyID，
+// 仍然可以读取，新的数据文件总是使用当前格式，旧格式的数据文件由数据压缩或者 Upgrade 重写。
+const (
+	formatMajor uint8 = 2
+	formatMinor uint8 = 0
+
+	regionFlagEncrypted uint8 = 1 << 0
+	regionFlagSealed    uint8 = 1 << 1
+
+	// 数据文件头的最大长度
+	maxRegionHeaderSize = 12
+)
+
+var (
+	regionMagic = []byte{0xDB, 'V', 'D', 'B'}
+
+	// 格式 1.0 的数据文件头
+	dataFileMetadata      = []byte{0xDB, 0x0, 0x0, 0x1}
+	encryptedFileMetadata = []byte{0xDB, 0x0, 0x1, 0x1}
+
+	legacyFormat  = formatVersion{1, 0}
+	currentFormat = formatVersion{formatMajor, formatMinor}
+
+	// ErrUnsupportedFormat is returned when a region file is written in a format this version can not read
+	ErrUnsupportedFormat = errors.New("unsupported data file format")
+
+	errShortHeader = errors.New("file is too short to contain valid signature")
+)
+
+// formatVersion 是数据文件格式的版本号
+type formatVersion struct {
+	major, minor uint8
+}
+
+func (v formatVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// older 判断 v 是否早于 other
+func (v formatVersion) older(other formatVersion) bool {
+	return v.major < other.major || v.major == other.major && v.minor < other.minor
+}
+
+// fileHeader 是解析之后的数据文件头
+type fileHeader struct {
+	version formatVersion
+	keyID   uint32 // Encryption key ID, 0 for plain regions
+	sealed  bool   // Written by compaction or rotated, never appended to
+}
+
+// newFileHeader 返回当前格式的数据文件头
+func newFileHeader(keyID uint32) fileHeader {
+	return fileHeader{version: currentFormat, keyID: keyID}
+}
+
+// newSealedHeader 返回数据压缩生成的数据文件使用的文件头
+func newSealedHeader(keyID uint32) fileHeader {
+	return fileHeader{version: currentFormat, keyID: keyID, sealed: true}
+}
+
+// bytes 按照文件头的格式版本编码文件头
+func (h fileHeader) bytes() []byte {
+	var buf []byte
+	if h.version == legacyFormat {
+		if h.keyID == 0 {
+			return append(buf, dataFileMetadata...)
+		}
+		buf = append(buf, encryptedFileMetadata...)
+	} else {
+		var flags uint8
+		if h.keyID != 0 {
+			flags |= regionFlagEncrypted
+		}
+		if h.sealed {
+			flags |= regionFlagSealed
+		}
+		buf = append(buf, regionMagic...)
+		buf = append(buf, h.version.major, h.version.minor, flags, 0)
+		if h.keyID == 0 {
+			return buf
+		}
+	}
+	return binary.BigEndian.AppendUint32(buf, h.keyID)
+}
+
+// size 返回文件头的长度，也就是第一条记录的偏移量
+func (h fileHeader) size() int64 {
+	return int64(len(h.bytes()))
+}
+
+// upgradable 判断数据文件需要重写为当前格式
+func (h fileHeader) upgradable() bool {
+	return h.version.older(currentFormat)
+}
+
+// sealRegion 在数据文件头中设置封存标记并同步，返回新的文件头，格式 1.0 的文件头没有标记位，保持不变
+func sealRegion(file File, h fileHeader) (fileHeader, error) {
+	if h.sealed || h.version == legacyFormat {
+		return h, nil
+	}
+
+	h.sealed = true
+	if _, err := file.WriteAt(h.bytes(), 0); err != nil {
+		return fileHeader{}, err
+	}
+
+	return h, file.Sync()
+}
+
+// regionHeader 返回新的数据文件使用的文件头，加密的数据文件在文件头之后保存密钥 ID
+func regionHeader(keyID uint32) []byte {
+	return newFileHeader(keyID).bytes()
+}
+
+// regionHeaderSize 返回使用 keyID 加密的新数据文件的文件头大小
+func regionHeaderSize(keyID uint32) int64 {
+	return newFileHeader(keyID).size()
+}
+
+// readRegionHeader 读取并校验数据文件头
+func readRegionHeader(file File) (fileHeader, error) {
+	var buf [maxRegionHeaderSize]byte
+	n, err := file.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, err
+	}
+
+	return parseRegionHeader(buf[:n], file.Name())
+}
+
+// parseRegionHeader 解析数据文件开头的字节，支持当前主版本和格式 1.0，name 只用于错误信息
+func parseRegionHeader(buf []byte, name string) (fileHeader, error) {
+	if len(buf) < len(regionMagic) {
+		return fileHeader{}, errShortHeader
+	}
+
+	var (
+		h         fileHeader
+		encrypted bool
+		size      int
+	)
+	switch {
+	case bytes.Equal(buf[:4], dataFileMetadata):
+		return fileHeader{version: legacyFormat}, nil
+	case bytes.Equal(buf[:4], encryptedFileMetadata):
+		h.version, encrypted, size = legacyFormat, true, len(encryptedFileMetadata)
+	case bytes.Equal(buf[:4], regionMagic):
+		if len(buf) < len(regionMagic)+4 {
+			return fileHeader{}, errShortHeader
+		}
+		h.version = formatVersion{buf[4], buf[5]}
+		if h.version.major != formatMajor {
+			return fileHeader{}, fmt.Errorf("%w %s: %v", ErrUnsupportedFormat, h.version, name)
+		}
+		flags := buf[6]
+		if flags&^(regionFlagEncrypted|regionFlagSealed) != 0 {
+			return fileHeader{}, fmt.Errorf("%w: unknown flags %#x: %v", ErrUnsupportedFormat, flags, name)
+		}
+		h.sealed = flags&regionFlagSealed != 0
+		encrypted, size = flags&regionFlagEncrypted != 0, len(regionMagic)+4
+	default:
+		return fileHeader{}, fmt.Errorf("%w: %v", ErrUnsupportedFormat, name)
+	}
+
+	if !encrypted {
+		return h, nil
+	}
+	if len(buf) < size+keyIDSize {
+		return fileHeader{}, errShortHeader
+	}
+	h.keyID = binary.BigEndian.Uint32(buf[size : size+keyIDSize])
+	if h.keyID == 0 {
+		return fileHeader{}, fmt.Errorf("invalid encryption key id 0: %v", name)
+	}
+
+	return h, nil
+}
+
+// outdatedRegion 判断数据文件是否需要由数据压缩重写：没有使用活跃密钥加密或者使用旧的格式，
+// 调用者需要持有读锁或者写锁
+func (lfs *LogStructuredFS) outdatedRegion(id uint16) bool {
+	header := lfs.regionHeaders[id]
+	return header.keyID != lfs.keyring.activeID() || header.upgradable()
+}
@@ -0,0 +1,150 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRegionHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want fileHeader
+		err  error
+	}{
+		{"legacy", []byte{0xDB, 0, 0, 1}, fileHeader{version: legacyFormat}, nil},
+		{"legacy encrypted", []byte{0xDB, 0, 1, 1, 0, 0, 0, 7}, fileHeader{version: legacyFormat, keyID: 7}, nil},
+		{"current", regionHeader(0), newFileHeader(0), nil},
+		{"current encrypted", regionHeader(7), newFileHeader(7), nil},
+		{"sealed", newSealedHeader(7).bytes(), newSealedHeader(7), nil},
+		{"newer minor", []byte{0xDB, 'V', 'D', 'B', formatMajor, formatMinor + 1, 0, 0}, fileHeader{version: formatVersion{formatMajor, formatMinor + 1}}, nil},
+		{"newer major", []byte{0xDB, 'V', 'D', 'B', formatMajor + 1, 0, 0, 0}, fileHeader{}, ErrUnsupportedFormat},
+		{"unknown flags", []byte{0xDB, 'V', 'D', 'B', formatMajor, formatMinor, 0x80, 0}, fileHeader{}, ErrUnsupportedFormat},
+		{"unknown magic", []byte{0xDB, 0, 0, 2}, fileHeader{}, ErrUnsupportedFormat},
+		{"short", []byte{0xDB, 'V', 'D', 'B', formatMajor}, fileHeader{}, errShortHeader},
+		{"short key id", []byte{0xDB, 0, 1, 1, 0}, fileHeader{}, errShortHeader},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRegionHeader(tt.buf, tt.name)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("parseRegionHeader(%s) = %+v, %v, want %+v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+		if err == nil && string(got.bytes()) != string(tt.buf) {
+			t.Errorf("fileHeader(%s).bytes() = %v, want %v", tt.name, got.bytes(), tt.buf)
+		}
+	}
+}
+
+func TestRegionHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header fileHeader
+		want   []byte
+	}{
+		{"plain", newFileHeader(0), []byte{0xDB, 'V', 'D', 'B', 2, 0, 0x00, 0}},
+		{"encrypted", newFileHeader(7), []byte{0xDB, 'V', 'D', 'B', 2, 0, 0x01, 0, 0, 0, 0, 7}},
+		{"sealed", newSealedHeader(0), []byte{0xDB, 'V', 'D', 'B', 2, 0, 0x02, 0}},
+		{"sealed encrypted", newSealedHeader(7), []byte{0xDB, 'V', 'D', 'B', 2, 0, 0x03, 0, 0, 0, 0, 7}},
+		{"legacy", fileHeader{version: legacyFormat}, []byte{0xDB, 0, 0, 1}},
+		{"legacy encrypted", fileHeader{version: legacyFormat, keyID: 7}, []byte{0xDB, 0, 1, 1, 0, 0, 0, 7}},
+	}
+
+	// 文件头的编码是磁盘格式的一部分，修改之后旧的数据文件无法读取
+	for _, tt := range tests {
+		if got := tt.header.bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("fileHeader(%s).bytes() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// downgradeTestRegions 将数据目录中的数据文件改写为格式 1.0，索引快照中的偏移量随之失效
+func downgradeTestRegions(t *testing.T, dir string) {
+	t.Helper()
+
+	ids, err := listRegions(OSFileSystem, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		name := filepath.Join(dir, regionFileName(id))
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(append([]byte(nil), dataFileMetadata...), buf[regionHeaderSize(0):]...)
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+}
+
+func TestUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 1024
+	for i := 0; i < 20; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+	downgradeTestRegions(t, dir)
+
+	// 旧格式的数据文件可以直接读取，活跃数据文件被封存，压缩会重写全部旧格式的数据文件
+	lfs = openTestFS(t, dir)
+	if header := lfs.regionHeaders[lfs.regionID]; header != newFileHeader(0) {
+		t.Errorf("active region header = %+v, want the current format", header)
+	}
+	legacy := 0
+	for id := range lfs.regions {
+		if lfs.regionHeaders[id].upgradable() {
+			legacy++
+		}
+	}
+	if dirty := lfs.compressor.DirtyRegions(); len(dirty) != legacy || legacy == 0 {
+		t.Errorf("DirtyRegions() = %v, want %d legacy regions", dirty, legacy)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) from legacy region error: %v", i, err)
+		}
+	}
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(dir, nil)
+	if err != nil || !report.Healthy() || report.Regions[0].Format != legacyFormat.String() {
+		t.Fatalf("Check() = %+v, %v, want a healthy directory with legacy regions", report, err)
+	}
+
+	stat, err := Upgrade(dir, nil)
+	if err != nil {
+		t.Fatalf("Upgrade() error: %v", err)
+	}
+	if stat.Regions != legacy || stat.Format != currentFormat.String() {
+		t.Errorf("Upgrade() = %+v, want %d regions upgraded to %s", stat, legacy, currentFormat)
+	}
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	for id, header := range lfs.regionHeaders {
+		if header.upgradable() {
+			t.Errorf("region %d is still in format %s after Upgrade()", id, header.version)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) after Upgrade() error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package vfs
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+)
+
+var (
+	// 索引分片数量的上限
+	maxIndexShards = 1 << 12
+	// 自适应分片检查锁竞争的时间间隔
+	shardTuneInterval = 10 * time.Second
+	// 两次检查之间加锁次数少于该值时不调整分片
+	shardTuneMinAcquires uint64 = 10000
+	// 发生竞争的加锁比例超过该值时分片数量翻倍
+	shardTuneRatio = 0.05
+)
+
+// indexMap 使用完整的 key 作为索引，不同的 key 即使哈希值冲突也不会互相覆盖
+type indexMap struct {
+	mux   sync.RWMutex      // 每个分片使用独立的锁
+	index map[string]*INode // 存储映射
+	moved bool              // 重新分片之后为 true，持有锁的调用者需要改用新的分片表
+
+	acquires  atomic.Uint64 // 加锁次数
+	contended atomic.Uint64 // 需要等待的加锁次数
+	waitNanos atomic.Int64  // 等待锁的总时间
+}
+
+// lock 对分片加写锁并记录锁竞争
+func (m *indexMap) lock() {
+	m.acquires.Add(1)
+	if m.mux.TryLock() {
+		return
+	}
+	m.contended.Add(1)
+	start := time.Now()
+	m.mux.Lock()
+	m.waitNanos.Add(int64(time.Since(start)))
+}
+
+// rlock 对分片加读锁并记录锁竞争
+func (m *indexMap) rlock() {
+	m.acquires.Add(1)
+	if m.mux.TryRLock() {
+		return
+	}
+	m.contended.Add(1)
+	start := time.Now()
+	m.mux.RLock()
+	m.waitNanos.Add(int64(time.Since(start)))
+}
+
+// shardTable 是一组数量为 2 的幂的索引分片，重新分片时整体替换
+type shardTable struct {
+	shards []*indexMap
+	mask   uint64
+}
+
+func newShardTable(n int) *shardTable {
+	table := &shardTable{
+		shards: make([]*indexMap, n),
+		mask:   uint64(n - 1),
+	}
+	for i := range table.shards {
+		table.shards[i] = &indexMap{index: make(map[string]*INode)}
+	}
+	return table
+}
+
+// shard 根据哈希值的低位选择分片
+func (t *shardTable) shard(hash uint64) *indexMap {
+	return t.shards[hash&t.mask]
+}
+
+// validShards 判断 n 是否是合法的分片数量
+func validShards(n int) bool {
+	return n > 0 && n <= maxIndexShards && n&(n-1) == 0
+}
+
+// defaultIndexShards 返回不小于 GOMAXPROCS 四倍的 2 的幂
+func defaultIndexShards() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 && n < maxIndexShards {
+		n <<= 1
+	}
+	return n
+}
+
+// lockShard 返回 key 所在的分片并加写锁，分片表已经被替换时在新的分片表中重试
+func (lfs *LogStructuredFS) lockShard(key string) *indexMap {
+	hash := HashSum64(key)
+	for {
+		shard := lfs.index.Load().shard(hash)
+		shard.lock()
+		if !shard.moved {
+			return shard
+		}
+		shard.mux.Unlock()
+	}
+}
+
+// rlockShard 返回 key 所在的分片并加读锁，分片表已经被替换时在新的分片表中重试
+func (lfs *LogStructuredFS) rlockShard(key string) *indexMap {
+	hash := HashSum64(key)
+	for {
+		shard := lfs.index.Load().shard(hash)
+		shard.rlock()
+		if !shard.moved {
+			return shard
+		}
+		shard.mux.RUnlock()
+	}
+}
+
+// rangeShards 依次对每个分片加读锁后调用 fn，期间不会重新分片
+func (lfs *LogStructuredFS) rangeShards(fn func(index map[string]*INode)) {
+	lfs.reshardMu.RLock()
+	defer lfs.reshardMu.RUnlock()
+
+	for _, shard := range lfs.index.Load().shards {
+		shard.rlock()
+		fn(shard.index)
+		shard.mux.RUnlock()
+	}
+}
+
+// Reshard redistributes the index over n shards without blocking readers for
+// longer than the copy, n must be a power of two.
+func (lfs *LogStructuredFS) Reshard(n int) error {
+	if !validShards(n) {
+		return fmt.Errorf("index shards %d is not a power of two in [1, %d]", n, maxIndexShards)
+	}
+
+	lfs.reshardMu.Lock()
+	defer lfs.reshardMu.Unlock()
+
+	old := lfs.index.Load()
+	if len(old.shards) == n {
+		return nil
+	}
+
+	// 锁住所有旧的分片，复制完成之后旧的分片不再被修改
+	for _, shard := range old.shards {
+		shard.mux.Lock()
+	}
+
+	table := newShardTable(n)
+	for _, shard := range old.shards {
+		for key, inode := range shard.index {
+			table.shard(HashSum64(key)).index[key] = inode
+		}
+		shard.moved = true
+	}
+	lfs.index.Store(table)
+
+	for _, shard := range old.shards {
+		shard.mux.Unlock()
+	}
+
+	clog.Infof("Resharded index of %s from %d to %d shards", lfs.path, len(old.shards), n)
+
+	return nil
+}
+
+// ShardStat is the lock contention of an index shard since the last resharding.
+type ShardStat struct {
+	Keys      int           `json:"keys"`      // Number of keys in the shard
+	Acquires  uint64        `json:"acquires"`  // Number of lock acquisitions
+	Contended uint64        `json:"contended"` // Number of acquisitions which had to wait
+	Wait      time.Duration `json:"wait_ns"`   // Total time spent waiting for the lock
+}
+
+// ShardStats returns the contention metrics of every index shard.
+func (lfs *LogStructuredFS) ShardStats() []ShardStat {
+	lfs.reshardMu.RLock()
+	defer lfs.reshardMu.RUnlock()
+
+	shards := lfs.index.Load().shards
+	stats := make([]ShardStat, len(shards))
+	for i, shard := range shards {
+		shard.mux.RLock()
+		stats[i].Keys = len(shard.index)
+		shard.mux.RUnlock()
+		stats[i].Acquires = shard.acquires.Load()
+		stats[i].Contended = shard.contended.Load()
+		stats[i].Wait = time.Duration(shard.waitNanos.Load())
+	}
+
+	return stats
+}
+
+// shardTuner 记录上一次检查时的锁竞争计数
+type shardTuner struct {
+	table     *shardTable
+	acquires  uint64
+	contended uint64
+}
+
+// tuneShards 在两次检查之间锁竞争过多时将分片数量翻倍
+func (lfs *LogStructuredFS) tuneShards() error {
+	table := lfs.index.Load()
+
+	var acquires, contended uint64
+	for _, shard := range table.shards {
+		acquires += shard.acquires.Load()
+		contended += shard.contended.Load()
+	}
+
+	last := lfs.tuner
+	lfs.tuner = shardTuner{table: table, acquires: acquires, contended: contended}
+	if last.table != table {
+		return nil
+	}
+
+	acquires, contended = acquires-last.acquires, contended-last.contended
+	if acquires < shardTuneMinAcquires || float64(contended) < float64(acquires)*shardTuneRatio {
+		return nil
+	}
+
+	n := len(table.shards) * 2
+	if n > maxIndexShards {
+		return nil
+	}
+
+	return lfs.Reshard(n)
+}
@@ -0,0 +1,115 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestOptions_IndexShards(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !validShards(opts.IndexShards) {
+		t.Errorf("default index shards = %d, want a power of two", opts.IndexShards)
+	}
+
+	opts.IndexShards = 5
+	if err := opts.validate(); err == nil {
+		t.Error("validate() should reject 5 index shards")
+	}
+}
+
+func TestLogStructuredFS_Reshard(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.IndexShards = 2
+	lfs := openTestFSWith(t, t.TempDir(), opts)
+	defer lfs.CloseFS()
+
+	for i := 0; i < 200; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 重新分片期间并发读写索引
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				if _, err := lfs.FetchSegment(key); err != nil {
+					t.Errorf("FetchSegment(%s) error: %v", key, err)
+					return
+				}
+				lfs.AddINode(fmt.Sprintf("extra-%d-%d", w, i), &INode{})
+			}
+		}(w)
+	}
+	for _, n := range []int{4, 64, 8} {
+		if err := lfs.Reshard(n); err != nil {
+			t.Fatalf("Reshard(%d) error: %v", n, err)
+		}
+	}
+	wg.Wait()
+
+	if err := lfs.Reshard(3); err == nil {
+		t.Error("Reshard(3) should fail")
+	}
+
+	stats := lfs.ShardStats()
+	if len(stats) != 8 {
+		t.Fatalf("ShardStats() has %d shards, want 8", len(stats))
+	}
+
+	total := 0
+	for _, stat := range stats {
+		total += stat.Keys
+	}
+	if want := 200 + 4*200; total != want {
+		t.Errorf("keys after resharding = %d, want %d", total, want)
+	}
+
+	for _, shard := range lfs.index.Load().shards {
+		for key := range shard.index {
+			if lfs.index.Load().shard(HashSum64(key)) != shard {
+				t.Fatalf("key %s is in the wrong shard", key)
+			}
+		}
+	}
+}
+
+func TestLogStructuredFS_TuneShards(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.IndexShards = 4
+	lfs := openTestFSWith(t, t.TempDir(), opts)
+	defer lfs.CloseFS()
+
+	// 第一次检查只记录计数
+	if err := lfs.tuneShards(); err != nil {
+		t.Fatal(err)
+	}
+
+	shard := lfs.index.Load().shards[0]
+	shard.acquires.Add(shardTuneMinAcquires)
+	if err := lfs.tuneShards(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lfs.index.Load().shards); n != 4 {
+		t.Fatalf("shards without contention = %d, want 4", n)
+	}
+
+	shard.acquires.Add(shardTuneMinAcquires)
+	shard.contended.Add(shardTuneMinAcquires / 2)
+	if err := lfs.tuneShards(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lfs.index.Load().shards); n != 8 {
+		t.Errorf("shards under contention = %d, want 8", n)
+	}
+}
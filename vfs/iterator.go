@@ -0,0 +1,119 @@
+package vfs
+
+import "time"
+
+// Iterator walks keys in byte order within [start, end), an empty end is unbounded.
+// It does not hold locks between calls to Next, so keys written during
+// the iteration may or may not be visible. Expired keys are skipped.
+type Iterator struct {
+	index   *skiplist
+	alive   func(key string) bool
+	fetch   func(key string) (*Segment, error)
+	start   string
+	end     string
+	reverse bool
+	started bool
+	key     string
+}
+
+func newIterator(index *skiplist, start, end string, alive func(string) bool, fetch func(string) (*Segment, error)) *Iterator {
+	return &Iterator{index: index, start: start, end: end, alive: alive, fetch: fetch}
+}
+
+// Reverse returns an iterator over the same range in descending order.
+func (it *Iterator) Reverse() *Iterator {
+	reversed := *it
+	reversed.reverse = !it.reverse
+	reversed.started, reversed.key = false, ""
+	return &reversed
+}
+
+// After returns an iterator which resumes after key in the iteration order,
+// key does not need to exist, which makes it usable as a pagination cursor.
+func (it *Iterator) After(key string) *Iterator {
+	resumed := *it
+	resumed.started, resumed.key = true, key
+	return &resumed
+}
+
+// Next advances to the next key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	for {
+		key, ok := it.advance()
+		if !ok {
+			return false
+		}
+		it.started, it.key = true, key
+		if it.alive(key) {
+			return true
+		}
+	}
+}
+
+// advance 在有序索引中查找下一个 key，每一步都重新查找，迭代期间索引可以被修改
+func (it *Iterator) advance() (string, bool) {
+	if it.reverse {
+		var key string
+		var ok bool
+		switch {
+		case it.started:
+			key, ok = it.index.Lower(it.key)
+		case it.end == "":
+			key, ok = it.index.Last()
+		default:
+			key, ok = it.index.Lower(it.end)
+		}
+		return key, ok && it.within(key)
+	}
+
+	from := it.start
+	// 大于当前 key 的最小字符串
+	if it.started && it.key+"\x00" > from {
+		from = it.key + "\x00"
+	}
+	key, ok := it.index.Ceiling(from)
+	return key, ok && it.within(key)
+}
+
+// within 判断 key 是否在迭代范围内
+func (it *Iterator) within(key string) bool {
+	return key >= it.start && (it.end == "" || key < it.end)
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Segment reads the segment of the current key.
+func (it *Iterator) Segment() (*Segment, error) {
+	return it.fetch(it.key)
+}
+
+// prefixEnd 返回所有以 prefix 开头的 key 的上界，没有上界时返回空字符串
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Iterator returns an iterator over the keys in [start, end), an empty end is unbounded.
+func (lfs *LogStructuredFS) Iterator(start, end string) *Iterator {
+	return newIterator(lfs.keys, start, end, lfs.alive, lfs.FetchSegment)
+}
+
+// Prefix returns an iterator over the keys starting with prefix.
+func (lfs *LogStructuredFS) Prefix(prefix string) *Iterator {
+	return lfs.Iterator(prefix, prefixEnd(prefix))
+}
+
+// alive 判断 key 是否存在并且没有过期
+func (lfs *LogStructuredFS) alive(key string) bool {
+	inode, ok := lfs.GetINode(key)
+	return ok && !inode.isExpired(time.Now())
+}
@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// collectKeys 返回迭代器中剩余的所有 key
+func collectKeys(it *Iterator) []string {
+	keys := make([]string, 0)
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func TestSkiplist(t *testing.T) {
+	sl := newSkiplist()
+	want := make([]string, 0, 500)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%03d", (i*7)%500)
+		if !sl.Insert(key) {
+			t.Fatalf("Insert(%s) = false", key)
+		}
+		want = append(want, key)
+	}
+	if sl.Insert("key-000") {
+		t.Error("Insert() of an existing key = true")
+	}
+
+	for i := 0; i < 500; i += 2 {
+		if !sl.Delete(fmt.Sprintf("key-%03d", i)) {
+			t.Fatalf("Delete(key-%03d) = false", i)
+		}
+	}
+	if sl.Delete("missing") {
+		t.Error("Delete(missing) = true")
+	}
+
+	sort.Strings(want)
+	remain := make([]string, 0, 250)
+	for i, key := range want {
+		if i%2 == 1 {
+			remain = append(remain, key)
+		}
+	}
+
+	got := make([]string, 0, sl.Len())
+	for key, ok := sl.Ceiling(""); ok; key, ok = sl.Ceiling(key + "\x00") {
+		got = append(got, key)
+	}
+	if !reflect.DeepEqual(got, remain) {
+		t.Errorf("Ceiling() walk = %v, want %v", got, remain)
+	}
+	if sl.Len() != len(remain) {
+		t.Errorf("Len() = %d, want %d", sl.Len(), len(remain))
+	}
+
+	if key, ok := sl.Last(); !ok || key != "key-499" {
+		t.Errorf("Last() = %s, %v, want key-499", key, ok)
+	}
+	if key, ok := sl.Lower("key-100"); !ok || key != "key-099" {
+		t.Errorf("Lower(key-100) = %s, %v, want key-099", key, ok)
+	}
+	if _, ok := sl.Lower("key-001"); ok {
+		t.Error("Lower(key-001) found a key")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"user:", "user;"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLogStructuredFS_Iterator(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	for _, key := range []string{"user:3", "order:1", "user:1", "user:2", "order:2", "user;"} {
+		if err := lfs.PutSegment(key, newTestSegment(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lfs.DeleteSegment("user:2"); err != nil {
+		t.Fatal(err)
+	}
+
+	seg := newTestSegment("expired")
+	seg.SetTTL(time.Millisecond)
+	if err := lfs.PutSegment("user:0", seg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		name string
+		it   *Iterator
+		want []string
+	}{
+		{"all", lfs.Iterator("", ""), []string{"order:1", "order:2", "user:1", "user:3", "user;"}},
+		{"range", lfs.Iterator("order:2", "user:3"), []string{"order:2", "user:1"}},
+		{"prefix", lfs.Prefix("user:"), []string{"user:1", "user:3"}},
+		{"reverse", lfs.Prefix("user:").Reverse(), []string{"user:3", "user:1"}},
+		{"after", lfs.Iterator("", "").After("order:2"), []string{"user:1", "user:3", "user;"}},
+		{"reverse after", lfs.Iterator("", "").Reverse().After("user:1"), []string{"order:2", "order:1"}},
+	}
+	for _, tt := range tests {
+		if got := collectKeys(tt.it); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: keys = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	it := lfs.Prefix("order:")
+	if !it.Next() {
+		t.Fatal("Next() = false")
+	}
+	seg, err := it.Segment()
+	if err != nil || string(seg.data) != "order:1" {
+		t.Errorf("Segment() = %v, %v", seg, err)
+	}
+
+	// 重启之后从数据文件恢复有序索引
+	crashTestFS(lfs)
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	want := []string{"order:1", "order:2", "user:1", "user:3", "user;"}
+	if got := collectKeys(lfs.Iterator("", "")); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after restart = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryStorage_Iterator(t *testing.T) {
+	ms := newTestMemoryStorage(t, nil)
+
+	for _, key := range []string{"b", "a:2", "a:1", "c"} {
+		if err := ms.PutSegment(key, newTestSegment(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.DeleteSegment("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := collectKeys(ms.Iterator("", "")), []string{"a:1", "a:2", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Iterator() keys = %v, want %v", got, want)
+	}
+	if got, want := collectKeys(ms.Prefix("a:").Reverse()), []string{"a:2", "a:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Prefix().Reverse() keys = %v, want %v", got, want)
+	}
+}
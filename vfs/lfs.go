@@ -1,125 +1,623 @@
 package vfs
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/auula/vasedb/clog"
 	"github.com/auula/vasedb/conf"
 	"github.com/auula/vasedb/utils"
 )
 
 var (
-	once              sync.Once
-	indexShard        = 5
-	instance          *LogStructuredFS
 	dataFileExtension = ".vsdb"
-	dataFileMetadata  = []byte{0xDB, 0x0, 0x0, 0x1}
+	lockFileName      = "vasedb.lock"
+	// 默认单个数据文件大小，单位字节
+	defaultRegionThreshold = int64(102400 * 1024)
+
+	// ErrSegmentNotFound is returned when the key has no segment or the segment has expired
+	ErrSegmentNotFound = errors.New("segment not found")
+
+	// ErrKeyMismatch is returned when the record referenced by the index belongs to another key
+	ErrKeyMismatch = errors.New("record key mismatch")
+
+	// ErrLocked is returned when the data directory is opened by another process
+	ErrLocked = errors.New("data directory is locked by another process")
+
+	errRegionNotFound = errors.New("region not found")
 )
 
-// setupFS build vasedb file system
-func setupFS(path string) error {
-	if !utils.IsExist(path) {
-		err := os.MkdirAll(path, conf.FsPerm)
-		if err != nil {
-			return err
-		}
+// lockDir 锁定数据目录中的锁文件，防止多个进程同时打开同一个数据目录
+func lockDir(fsys FileSystem, path string) (io.Closer, error) {
+	lock, err := fsys.Lock(filepath.Join(path, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock data directory %s: %w", path, err)
 	}
+	return lock, nil
+}
+
+// regionFileName 返回数据文件名称，例如 0001.vsdb
+func regionFileName(id uint16) string {
+	return fmt.Sprintf("%04d%s", id, dataFileExtension)
+}
 
-	files, err := os.ReadDir(path)
+// parseRegionID 从数据文件名称中解析出 region id
+func parseRegionID(name string) (uint16, bool) {
+	if !strings.HasSuffix(name, dataFileExtension) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, dataFileExtension), 10, 16)
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
+		return 0, false
 	}
+	return uint16(id), true
+}
 
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), dataFileExtension) {
-			if len(file.Name()) == 8 && strings.HasPrefix(file.Name(), "000") {
-				file, err := os.Open(filepath.Join(path, file.Name()))
-				if err != nil {
-					return fmt.Errorf("failed to check data file: %w", err)
-				}
-				defer file.Close()
+// INode represents a file system node with metadata.
+type INode struct {
+	RegionID    uint16    // Unique identifier for the INode
+	Offset      uint32    // Offset within the file
+	Length      uint32    // Length of the encoded record
+	CreatedTime time.Time // Creation time of the INode
+	EexpireTime time.Time // Expiration time of the INode
+}
+
+// LogStructuredFS represents the virtual file storage system.
+type LogStructuredFS struct {
+	mu              sync.RWMutex               // Guards regions and the active region
+	path            string                     // Data directory of region files
+	index           atomic.Pointer[shardTable] // Index shards of INode references
+	reshardMu       sync.RWMutex               // Excludes resharding from full index scans
+	tuner           shardTuner                 // Contention counters of the last adaptive check
+	keys            *skiplist                  // Ordered keys of all index shards
+	fs              FileSystem                 // File system of the data directory
+	regions         map[uint16]File            // Archived files keyed by unique file ID
+	activeRegion    File                       // Currently active file for writing
+	regionID        uint16                     // Unique file ID of the active region
+	offset          int64                      // Write offset within the active region
+	regionThreshold int64                      // Maximum size of a region in bytes
+	lastCreated     int64                      // Timestamp of the latest appended record
+	stats           map[uint16]*regionStat
+	compressor      *Compressor
+	scrubber        *scrubber
+	syncMode        conf.SyncMode // Durability policy of appended records
+	syncInterval    time.Duration // Background fsync interval of SyncEvery
+	committer       *groupCommit
+	mmap            bool                   // Read regions through memory mappings
+	mmaps           map[uint16]*mmapRegion // Memory mappings keyed by region ID
+	directIO        bool                   // Write the active region with O_DIRECT
+	direct          *directWriter          // O_DIRECT writer of the active region
+	lock            io.Closer              // Lock of the data directory
+	compaction      bool                   // Run the compressor in the background
+	compactInterval time.Duration          // Interval between compaction cycles
+	scrub           bool                   // Verify sealed regions in the background
+	scrubInterval   time.Duration          // Interval between scrub passes
+	adaptiveShards  bool                   // Double the index shards under lock contention
+	codec           Codec                  // Compression codec of new record values
+	compressMinSize int                    // Values smaller than this are not compressed
+	codecStats      codecStats             // Compression ratio of written values
+	keyring         *keyring               // Encryption keys, nil when encryption is disabled
+	regionHeaders   map[uint16]fileHeader  // Format version and encryption key ID of each region
+	pins            map[uint16]int         // Regions pinned by open backup snapshots
+	snapshotIDs     map[uint16]bool        // Regions referenced by the index snapshot on disk
+	closed          chan struct{}          // Closed when the file system shuts down
+	wg              sync.WaitGroup         // Waits for background tasks to exit
+}
+
+// openRegions 扫描数据目录中已有的数据文件恢复索引
+func (lfs *LogStructuredFS) openRegions(path string) error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	lfs.path = path
+
+	err := lfs.recoverRegions()
+	if err != nil {
+		return err
+	}
 
-				err = validateFileHeader(file)
-				if err != nil {
-					return fmt.Errorf("failed to validated file header: %w", err)
+	lfs.runTask("index snapshot", snapshotInterval, lfs.saveIndexSnapshot)
+	lfs.runTask("expire sweeper", expireInterval, lfs.sweepExpired)
+
+	if lfs.syncMode == conf.SyncEvery {
+		lfs.runTask("sync", lfs.syncInterval, func() error {
+			_, err := lfs.syncActiveRegion()
+			return err
+		})
+	}
+
+	if lfs.compaction && lfs.compactInterval > 0 {
+		lfs.runTask("compressor", lfs.compactInterval, lfs.compressor.Compact)
+	}
+
+	if lfs.scrub {
+		lfs.runTask("scrubber", lfs.scrubInterval, lfs.scrubber.Scrub)
+	}
+
+	if lfs.adaptiveShards {
+		lfs.runTask("index shard tuner", shardTuneInterval, lfs.tuneShards)
+	}
+
+	return nil
+}
+
+// runTask 周期性地在后台执行任务，直到文件系统关闭
+func (lfs *LogStructuredFS) runTask(name string, interval time.Duration, task func() error) {
+	lfs.wg.Add(1)
+	go func() {
+		defer lfs.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-lfs.closed:
+				return
+			case <-ticker.C:
+				if err := task(); err != nil {
+					clog.Errorf("Background task %s failed: %v", name, err)
 				}
 			}
 		}
+	}()
+}
+
+// allocRegionID 分配一个新的数据文件 id。数据压缩和滚动不断消耗 id，被删除的数据文件的 id 会被重复使用，
+// 所以 id 的大小不代表写入顺序。磁盘上的索引快照引用的 id 在下一次保存快照之前不能使用，
+// 否则崩溃之后旧的快照会指向新的数据文件。调用者需要持有写锁
+func (lfs *LogStructuredFS) allocRegionID() (uint16, error) {
+	return unusedRegionID(lfs.fs, lfs.path, func(id uint16) bool {
+		_, ok := lfs.regions[id]
+		return ok || id == lfs.regionID || lfs.snapshotIDs[id]
+	})
+}
+
+// unusedRegionID 返回最小的没有被 used 占用并且磁盘上不存在对应的数据文件、临时文件和隔离文件的 id
+func unusedRegionID(fsys FileSystem, path string, used func(uint16) bool) (uint16, error) {
+	for id := 1; id <= math.MaxUint16; id++ {
+		if used(uint16(id)) {
+			continue
+		}
+
+		name := filepath.Join(path, regionFileName(uint16(id)))
+		exists := false
+		for _, suffix := range []string{"", compactFileExtension, damagedFileExtension} {
+			// 无法确定文件是否存在时不使用这个 id
+			if _, err := fsys.Stat(name + suffix); !os.IsNotExist(err) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return uint16(id), nil
+		}
+	}
+
+	return 0, errors.New("region id space is exhausted")
+}
+
+// createActiveRegion 创建一个新的数据文件作为活跃数据文件，调用者需要持有写锁
+func (lfs *LogStructuredFS) createActiveRegion() error {
+	id, err := lfs.allocRegionID()
+	if err != nil {
+		return err
+	}
+
+	file, err := lfs.fs.OpenFile(filepath.Join(lfs.path, regionFileName(id)), os.O_RDWR|os.O_CREATE|os.O_EXCL, conf.FsPerm)
+	if err != nil {
+		return fmt.Errorf("failed to create region file: %w", err)
 	}
 
-	initializedLFS()
+	// 新的数据文件总是使用活跃密钥加密
+	keyID := lfs.keyring.activeID()
+	header := regionHeader(keyID)
+	_, err = file.WriteAt(header, 0)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write region header: %w", err)
+	}
+
+	lfs.activeRegion = file
+	lfs.regionID = id
+	lfs.offset = int64(len(header))
+	lfs.stats[id] = new(regionStat)
+	lfs.regionHeaders[id] = newFileHeader(keyID)
+	lfs.mapRegion(id, file)
+	lfs.openDirect()
 
 	return nil
 }
 
-func validateFileHeader(file *os.File) error {
-	var fileHeader [4]byte
-	n, err := file.Read(fileHeader[:])
+// rotateRegion 封存当前活跃数据文件并切换到新的数据文件，调用者需要持有写锁
+func (lfs *LogStructuredFS) rotateRegion() error {
+	// 封存的数据文件末尾不能有 O_DIRECT 写入的填充数据
+	if err := lfs.closeDirect(); err != nil {
+		return err
+	}
+
+	if err := lfs.activeRegion.Sync(); err != nil {
+		return fmt.Errorf("failed to sync active region: %w", err)
+	}
+
+	// 先在文件头中标记封存再创建新的活跃数据文件，恢复时没有封存的数据文件就是活跃数据文件
+	sealed, sealedID := lfs.activeRegion, lfs.regionID
+	header := lfs.regionHeaders[sealedID]
+	sealedHeader, err := sealRegion(sealed, header)
 	if err != nil {
+		return fmt.Errorf("failed to seal active region: %w", err)
+	}
+	lfs.regionHeaders[sealedID] = sealedHeader
+
+	if err := lfs.createActiveRegion(); err != nil {
+		// 继续使用原来的活跃数据文件，恢复文件头中的标记
+		if _, werr := sealed.WriteAt(header.bytes(), 0); werr == nil {
+			lfs.regionHeaders[sealedID] = header
+		}
 		return err
 	}
 
-	if n != 4 {
-		return errors.New("file is too short to contain valid signature")
+	lfs.regions[sealedID] = sealed
+
+	return nil
+}
+
+// nextTimestamp 返回单调递增的记录时间戳，调用者需要持有写锁
+func (lfs *LogStructuredFS) nextTimestamp() int64 {
+	now := time.Now().UnixNano()
+	if now <= lfs.lastCreated {
+		now = lfs.lastCreated + 1
+	}
+	lfs.lastCreated = now
+	return now
+}
+
+// PutSegment appends seg to the active region and indexes it under key.
+func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
+	if key == "" {
+		return errors.New("segment key is empty")
 	}
 
-	if !bytes.Equal(fileHeader[:], dataFileMetadata[:]) {
-		return fmt.Errorf("unsupported data file version: %v", file.Name())
+	if err := lfs.putSegment(key, seg); err != nil {
+		return err
+	}
+
+	return lfs.commitSync()
+}
+
+func (lfs *LogStructuredFS) putSegment(key string, seg *Segment) error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// key 和时间戳只写入副本，不修改调用者的 Segment
+	stored := *seg
+	stored.key = key
+	inode, err := lfs.appendSegment(&stored)
+	if err != nil {
+		return err
+	}
+
+	old := lfs.swapINode(key, inode)
+	if old != nil {
+		lfs.markGarbage(old)
 	}
 
 	return nil
 }
 
-// INode represents a file system node with metadata.
-type INode struct {
-	RegionID    uint16    // Unique identifier for the INode
-	Offset      uint32    // Offset within the file
-	CreatedTime time.Time // Creation time of the INode
-	EexpireTime time.Time // Expiration time of the INode
+// DeleteSegment appends a tombstone record for key and removes it from the index.
+func (lfs *LogStructuredFS) DeleteSegment(key string) error {
+	if err := lfs.deleteSegment(key); err != nil {
+		return err
+	}
+
+	return lfs.commitSync()
+}
+
+func (lfs *LogStructuredFS) deleteSegment(key string) error {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	inode, ok := lfs.GetINode(key)
+	if !ok {
+		return ErrSegmentNotFound
+	}
+
+	// 已经过期的 key 和 MemoryStorage 一样视为不存在，只删除索引，不需要追加删除标记
+	if inode.isExpired(time.Now()) {
+		if lfs.removeINodeIf(key, inode) {
+			lfs.markGarbage(inode)
+		}
+		return ErrSegmentNotFound
+	}
+
+	tombstone := &Segment{kind: Binary, flags: flagTombstone, key: key}
+	tomb, err := lfs.appendSegment(tombstone)
+	if err != nil {
+		return err
+	}
+
+	// 删除标记本身不会被索引引用，直接计入垃圾数据，由数据压缩决定何时可以丢弃
+	lfs.markGarbage(tomb)
+	if old := lfs.removeINode(key); old != nil {
+		lfs.markGarbage(old)
+	}
+
+	return nil
 }
 
-type indexMap struct {
-	mux   sync.RWMutex      // 每个分片使用独立的锁
-	index map[uint64]*INode // 存储映射
+// appendSegment 将记录追加到活跃数据文件并返回对应的 INode，调用者需要持有写锁
+func (lfs *LogStructuredFS) appendSegment(seg *Segment) (*INode, error) {
+	seg.createdAt = lfs.nextTimestamp()
+	return lfs.appendRecord(seg)
 }
 
-// LogStructuredFS represents the virtual file storage system.
-type LogStructuredFS struct {
-	indexs       []*indexMap         // Index mapping for INode references
-	regions      map[uint16]*os.File // Archived files keyed by unique file ID
-	activeRegion *os.File            // Currently active file for writing
+// appendRecord 使用记录中已有的时间戳追加记录，调用者需要持有写锁
+func (lfs *LogStructuredFS) appendRecord(seg *Segment) (*INode, error) {
+	// 打开时保证活跃数据文件使用活跃密钥，滚动之后的数据文件使用同一个密钥
+	aead, err := lfs.regionCipher(lfs.regionID)
+	if err != nil {
+		return nil, err
+	}
+
+	seg = withEncryption(lfs.compressSegment(seg), aead)
+	record, err := encodeRecord(seg, aead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode segment: %w", err)
+	}
+
+	// 数据文件超过阈值之后滚动到新的数据文件，空文件至少写入一条记录
+	if lfs.offset+int64(len(record)) > lfs.regionThreshold && lfs.offset > lfs.regionHeaders[lfs.regionID].size() {
+		if err := lfs.rotateRegion(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 使用 WriteAt 写入，写入失败时下次写入会覆盖不完整的数据
+	if lfs.direct != nil {
+		_, err = lfs.direct.WriteAt(record, lfs.offset)
+	} else {
+		_, err = lfs.activeRegion.WriteAt(record, lfs.offset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to append segment: %w", err)
+	}
+
+	inode := newINode(lfs.regionID, lfs.offset, seg)
+
+	stat := lfs.stats[lfs.regionID]
+	if stat.minCreated == 0 {
+		stat.minCreated = seg.createdAt
+	}
+	stat.size += int64(len(record))
+	lfs.offset += int64(len(record))
+
+	return inode, nil
+}
+
+// markGarbage 将 INode 引用的记录计入所在数据文件的垃圾数据，调用者需要持有写锁
+func (lfs *LogStructuredFS) markGarbage(inode *INode) {
+	if stat, ok := lfs.stats[inode.RegionID]; ok {
+		stat.garbage += int64(inode.Length)
+	}
+}
+
+// FetchSegment reads and verifies the segment stored under key.
+func (lfs *LogStructuredFS) FetchSegment(key string) (*Segment, error) {
+	for {
+		inode, ok := lfs.GetINode(key)
+		if !ok {
+			return nil, ErrSegmentNotFound
+		}
+
+		// 惰性过期，读取时发现过期直接删除索引
+		if inode.isExpired(time.Now()) {
+			lfs.expireINode(key, inode)
+			return nil, ErrSegmentNotFound
+		}
+
+		seg, err := lfs.readSegment(key, inode)
+		if errors.Is(err, errRegionNotFound) {
+			// 数据文件在读取期间被回收了，索引已经指向新的位置，重新读取
+			if latest, ok := lfs.GetINode(key); ok && latest != inode {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// 返回给调用者的 Segment 不再带有加密标记
+		seg.flags &^= flagEncrypted
+		return decompressSegment(seg)
+	}
+}
+
+// readSegment 根据 INode 读取数据文件中的记录并校验 Checksum 和 key
+func (lfs *LogStructuredFS) readSegment(key string, inode *INode) (*Segment, error) {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+	return lfs.readRegion(key, inode)
+}
+
+// readRegion 读取 INode 引用的记录，调用者需要持有读锁或者写锁
+func (lfs *LogStructuredFS) readRegion(key string, inode *INode) (*Segment, error) {
+	file, ok := lfs.regionFile(inode.RegionID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errRegionNotFound, inode.RegionID)
+	}
+
+	aead, err := lfs.regionCipher(inode.RegionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var seg *Segment
+	if m, ok := lfs.mmaps[inode.RegionID]; ok {
+		seg, err = m.decodeAt(int64(inode.Offset), int(inode.Length), aead)
+	} else {
+		seg, err = lfs.preadSegment(file, inode, aead)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode region %d at offset %d: %w", inode.RegionID, inode.Offset, err)
+	}
+
+	// 记录中保存了完整的 key，防止索引指向了错误的记录
+	if seg.key != key {
+		return nil, fmt.Errorf("%w: region %d at offset %d holds key %q", ErrKeyMismatch, inode.RegionID, inode.Offset, seg.key)
+	}
+
+	return seg, nil
+}
+
+// preadSegment 通过 pread 读取并解码 INode 引用的记录
+func (lfs *LogStructuredFS) preadSegment(file File, inode *INode, aead cipher.AEAD) (*Segment, error) {
+	buf := make([]byte, inode.Length)
+	if _, err := file.ReadAt(buf, int64(inode.Offset)); err != nil {
+		return nil, err
+	}
+	return decodeRecord(buf, aead)
+}
+
+// regionFile 根据 id 返回对应的数据文件，调用者需要持有读锁
+func (lfs *LogStructuredFS) regionFile(id uint16) (File, bool) {
+	if id == lfs.regionID {
+		return lfs.activeRegion, true
+	}
+	file, ok := lfs.regions[id]
+	return file, ok
+}
+
+// newINode 根据记录在数据文件中的位置创建 INode
+func newINode(id uint16, offset int64, seg *Segment) *INode {
+	return &INode{
+		RegionID:    id,
+		Offset:      uint32(offset),
+		Length:      uint32(seg.recordSize()),
+		CreatedTime: time.Unix(0, seg.createdAt),
+		EexpireTime: unixTime(seg.expiredAt),
+	}
+}
+
+// unixTime 将纳秒时间戳转换为 time.Time，0 表示零值时间
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// Keys returns the names of all keys in the index in no particular order.
+func (lfs *LogStructuredFS) Keys() []string {
+	keys := make([]string, 0)
+	now := time.Now()
+	lfs.rangeShards(func(index map[string]*INode) {
+		for key, inode := range index {
+			if !inode.isExpired(now) {
+				keys = append(keys, key)
+			}
+		}
+	})
+	return keys
+}
+
+// 使用 `lockShard` 获取分片，并加锁进行操作
+func (lfs *LogStructuredFS) AddINode(key string, inode *INode) {
+	lfs.swapINode(key, inode)
 }
 
-// 根据某种哈希函数（如简单的模运算）来选择分片
-func (lfs *LogStructuredFS) getShardIndex(key uint64) *indexMap {
-	return lfs.indexs[key%uint64(indexShard)]
+// swapINode 替换索引并返回被替换的旧 INode
+func (lfs *LogStructuredFS) swapINode(key string, inode *INode) *INode {
+	shard := lfs.lockShard(key)
+	defer shard.mux.Unlock()
+	old := shard.index[key]
+	shard.index[key] = inode
+	if old == nil {
+		lfs.keys.Insert(key)
+	}
+	return old
 }
 
-// 使用 `getShardIndex` 获取分片，并加锁进行操作
-func (lfs *LogStructuredFS) AddINode(key uint64, inode *INode) {
-	shard := lfs.getShardIndex(key)
-	shard.mux.Lock()
+// relocateINode 仅当索引仍然指向旧位置时替换为新的 INode
+func (lfs *LogStructuredFS) relocateINode(key string, id uint16, offset uint32, inode *INode) bool {
+	shard := lfs.lockShard(key)
 	defer shard.mux.Unlock()
+	old, ok := shard.index[key]
+	if !ok || old.RegionID != id || old.Offset != offset {
+		return false
+	}
 	shard.index[key] = inode
+	return true
 }
 
-func (lfs *LogStructuredFS) GetINode(key uint64) (*INode, bool) {
-	shard := lfs.getShardIndex(key)
-	shard.mux.RLock()
+func (lfs *LogStructuredFS) GetINode(key string) (*INode, bool) {
+	shard := lfs.rlockShard(key)
 	defer shard.mux.RUnlock()
 	inode, exists := shard.index[key]
 	return inode, exists
 }
 
-func (lfs *LogStructuredFS) BatchINodes(inodes ...*INode) {
+// removeINode 删除索引并返回被删除的 INode
+func (lfs *LogStructuredFS) removeINode(key string) *INode {
+	shard := lfs.lockShard(key)
+	defer shard.mux.Unlock()
+	old, ok := shard.index[key]
+	if ok {
+		delete(shard.index, key)
+		lfs.keys.Delete(key)
+	}
+	return old
+}
+
+// dropRegionINodes 删除仍然指向数据文件 id 的索引，并为这些 key 追加删除标记，防止其他数据文件中
+// 更旧的记录在下一次完整扫描时被恢复，返回删除的数量，调用者需要持有写锁
+func (lfs *LogStructuredFS) dropRegionINodes(id uint16) (int, error) {
+	dropped := make(map[string]*INode)
+	lfs.rangeShards(func(index map[string]*INode) {
+		for key, inode := range index {
+			if inode.RegionID == id {
+				dropped[key] = inode
+			}
+		}
+	})
+
+	for key, inode := range dropped {
+		lfs.removeINodeIf(key, inode)
+	}
 
+	for key := range dropped {
+		tombstone := &Segment{kind: Binary, flags: flagTombstone, key: key}
+		inode, err := lfs.appendSegment(tombstone)
+		if err != nil {
+			return len(dropped), fmt.Errorf("failed to append tombstone of lost key %q: %w", key, err)
+		}
+		lfs.markGarbage(inode)
+	}
+
+	return len(dropped), nil
+}
+
+// removeINodeIf 仅当索引仍然指向 inode 时删除索引
+func (lfs *LogStructuredFS) removeINodeIf(key string, inode *INode) bool {
+	shard := lfs.lockShard(key)
+	defer shard.mux.Unlock()
+	if shard.index[key] != inode {
+		return false
+	}
+	delete(shard.index, key)
+	lfs.keys.Delete(key)
+	return true
 }
 
 func HashSum64(key string) uint64 {
@@ -128,40 +626,141 @@ func HashSum64(key string) uint64 {
 	return h.Sum64()
 }
 
-func initializedLFS() {
-	once.Do(func() {
-		instance = &LogStructuredFS{
-			indexs:       make([]*indexMap, indexShard),
-			regions:      make(map[uint16]*os.File),
-			activeRegion: new(os.File),
-		}
+func newLogStructuredFS(opts *Options) *LogStructuredFS {
+	lfs := &LogStructuredFS{
+		keys:            newSkiplist(),
+		fs:              opts.FileSystem,
+		regions:         make(map[uint16]File),
+		regionThreshold: opts.RegionSize,
+		stats:           make(map[uint16]*regionStat),
+		regionHeaders:   make(map[uint16]fileHeader),
+		pins:            make(map[uint16]int),
+		snapshotIDs:     make(map[uint16]bool),
+		mmaps:           make(map[uint16]*mmapRegion),
+		mmap:            opts.Mode == conf.ModeMmap,
+		directIO:        opts.Mode == conf.ModeDirect,
+		compaction:      opts.Compaction,
+		compactInterval: opts.CompactionInterval,
+		scrub:           opts.Scrub,
+		scrubInterval:   opts.ScrubInterval,
+		adaptiveShards:  opts.AdaptiveShards,
+		compressMinSize: opts.CompressMinSize,
+		closed:          make(chan struct{}),
+	}
+	lfs.compressor = newCompressor(lfs, opts.GarbageThreshold)
+	lfs.scrubber = newScrubber(lfs, opts.ScrubRate)
+	lfs.committer = newGroupCommit()
+	lfs.syncMode, lfs.syncInterval, _ = conf.ParseSync(opts.Sync)
+	lfs.codec, _ = parseCodec(opts.Codec)
 
-		for i := 0; i < indexShard; i++ {
-			instance.indexs[i] = &indexMap{
-				mux:   sync.RWMutex{},
-				index: make(map[uint64]*INode),
-			}
+	lfs.index.Store(newShardTable(opts.IndexShards))
+
+	return lfs
+}
+
+// OpenFS opens the data directory at path as an independent file system instance,
+// nil opts uses the default configuration. The directory is locked until CloseFS.
+func OpenFS(path string, opts *Options) (*LogStructuredFS, error) {
+	if opts == nil {
+		opts = NewOptions(conf.Default)
+	}
+
+	// 复制一份，避免修改调用者的配置
+	o := *opts
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid file system options: %w", err)
+	}
+
+	if err := o.FileSystem.MkdirAll(path, conf.FsPerm); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	var kr *keyring
+	if o.Encryption {
+		var err error
+		if kr, err = loadKeyring(o.KeyFile, o.KeyEnv); err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %w", err)
 		}
-	})
+	}
+
+	lock, err := lockDir(o.FileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	lfs := newLogStructuredFS(&o)
+	lfs.lock = lock
+	lfs.keyring = kr
+
+	if err := lfs.openRegions(path); err != nil {
+		lfs.closeFiles()
+		lock.Close()
+		return nil, fmt.Errorf("failed to open data directory %s: %w", path, err)
+	}
+
+	return lfs, nil
 }
 
-func OpenFS(path string) (*LogStructuredFS, error) {
-	setupFS(path)
-	// 单例子模式，但是挡不住其他包通过 new(LogStructuredFS) 也能创建一个实例，那这样根本不起作用了
-	return instance, nil
+// closeFiles 关闭恢复失败时已经打开的数据文件
+func (lfs *LogStructuredFS) closeFiles() {
+	for id := range lfs.mmaps {
+		lfs.unmapRegion(id)
+	}
+	if lfs.direct != nil {
+		lfs.direct.file.Close()
+	}
+	for _, file := range lfs.regions {
+		file.Close()
+	}
+	if lfs.activeRegion != nil {
+		lfs.activeRegion.Close()
+	}
 }
 
+// CloseFS stops background tasks, saves the index snapshot, closes all regions and unlocks the data directory.
 func (lfs *LogStructuredFS) CloseFS() error {
+	select {
+	case <-lfs.closed:
+		return errors.New("file system already closed")
+	default:
+		close(lfs.closed)
+	}
+
+	// 先停止后台任务，再保存索引快照，下次启动时可以从快照快速恢复。
+	// 任何一步失败都继续释放剩下的资源和目录锁，最后返回第一个错误
+	lfs.wg.Wait()
+	var err error
+	if serr := lfs.saveIndexSnapshot(); serr != nil {
+		err = fmt.Errorf("failed to save index snapshot: %w", serr)
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	for id := range lfs.mmaps {
+		if uerr := lfs.unmapRegion(id); uerr != nil && err == nil {
+			err = fmt.Errorf("failed to unmap region %d: %w", id, uerr)
+		}
+	}
+
 	for _, file := range lfs.regions {
-		if err := utils.CloseFile(file); err != nil {
-			return fmt.Errorf("failed to close region file: %w", err)
+		if cerr := utils.CloseFile(file); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close region file: %w", cerr)
 		}
 	}
 
-	if err := utils.CloseFile(lfs.activeRegion); err != nil {
-		return fmt.Errorf("failed to close active region: %w", err)
+	if derr := lfs.closeDirect(); derr != nil && err == nil {
+		err = derr
 	}
 
-	// 如果有 index 文件的快照，就从 index 文件快照进行恢复，如果没有就全局扫描
-	return nil
+	if cerr := utils.CloseFile(lfs.activeRegion); cerr != nil && err == nil {
+		err = fmt.Errorf("failed to close active region: %w", cerr)
+	}
+
+	// 关闭锁文件即释放目录锁
+	if lerr := lfs.lock.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+
+	return err
 }
@@ -0,0 +1,283 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/auula/vasedb/conf"
+)
+
+// openTestFS 在临时目录中创建一个独立的文件系统实例
+func openTestFS(t *testing.T, dir string) *LogStructuredFS {
+	t.Helper()
+	return openTestFSWith(t, dir, nil)
+}
+
+func openTestFSWith(t *testing.T, dir string, opts *Options) *LogStructuredFS {
+	t.Helper()
+
+	lfs, err := OpenFS(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenFS() error: %v", err)
+	}
+
+	return lfs
+}
+
+// crashTestFS 模拟进程崩溃，只关闭文件而不保存索引快照
+func crashTestFS(lfs *LogStructuredFS) {
+	close(lfs.closed)
+	lfs.wg.Wait()
+
+	lfs.closeFiles()
+	lfs.lock.Close()
+}
+
+func newTestSegment(value string) *Segment {
+	return &Segment{kind: Text, data: []byte(value)}
+}
+
+func TestLogStructuredFS_PutSegment(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	err := lfs.PutSegment("hello", newTestSegment("world"))
+	if err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	inode, ok := lfs.GetINode("hello")
+	if !ok {
+		t.Fatal("GetINode() not found after PutSegment()")
+	}
+
+	if inode.RegionID != 1 || inode.Offset != uint32(regionHeaderSize(0)) {
+		t.Errorf("GetINode() = %+v, want region 1 at offset %d", inode, regionHeaderSize(0))
+	}
+
+	err = lfs.PutSegment("", newTestSegment("world"))
+	if err == nil {
+		t.Error("PutSegment() with empty key should fail")
+	}
+}
+
+func TestOptions_RegionSize(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.RegionSize = math.MaxUint32
+	if err := opts.validate(); err != nil {
+		t.Errorf("validate() with a 4 GiB region error: %v", err)
+	}
+
+	opts.RegionSize = 8 << 30
+	if err := opts.validate(); err == nil {
+		t.Error("validate() should reject regions whose offsets overflow 32 bits")
+	}
+}
+
+func TestLogStructuredFS_RotateRegion(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	// 每个数据文件只能容纳两条记录
+	record := newTestSegment("value")
+	record.key = "key-0"
+	lfs.regionThreshold = regionHeaderSize(0) + int64(2*len(record.ToBytes()))
+
+	for i := 0; i < 6; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		inode, ok := lfs.GetINode(fmt.Sprintf("key-%d", i))
+		if !ok {
+			t.Fatalf("GetINode(key-%d) not found", i)
+		}
+		if want := uint16(i/2 + 1); inode.RegionID != want {
+			t.Errorf("key-%d in region %d, want %d", i, inode.RegionID, want)
+		}
+	}
+
+	for id := uint16(1); id <= 3; id++ {
+		info, err := os.Stat(filepath.Join(dir, regionFileName(id)))
+		if err != nil {
+			t.Fatalf("region %d is missing: %v", id, err)
+		}
+		if info.Size() > lfs.regionThreshold {
+			t.Errorf("region %d size %d exceeds threshold %d", id, info.Size(), lfs.regionThreshold)
+		}
+	}
+}
+
+func TestLogStructuredFS_FetchSegment(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	lfs.regionThreshold = 64
+	for i := 0; i < 4; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	// 数据分布在已封存的数据文件和活跃数据文件中
+	for i := 0; i < 4; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("FetchSegment() error: %v", err)
+		}
+		if string(seg.data) != fmt.Sprintf("value-%d", i) || seg.Kind() != Text {
+			t.Errorf("FetchSegment() = %+v", seg)
+		}
+	}
+
+	_, err := lfs.FetchSegment("missing")
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	inode, _ := lfs.GetINode("key-0")
+	inode.EexpireTime = time.Now().Add(-time.Second)
+	_, err = lfs.FetchSegment("key-0")
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	if _, ok := lfs.GetINode("key-0"); ok {
+		t.Error("FetchSegment() should remove expired INode")
+	}
+}
+
+func TestLogStructuredFS_FetchSegment_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	err := lfs.PutSegment("hello", newTestSegment("world"))
+	if err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	inode, _ := lfs.GetINode("hello")
+	_, err = lfs.activeRegion.WriteAt([]byte{0xFF}, int64(inode.Offset+inode.Length-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = lfs.FetchSegment("hello")
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestLogStructuredFS_DeleteSegment(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	err := lfs.PutSegment("hello", newTestSegment("world"))
+	if err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	offset := lfs.offset
+	if err := lfs.DeleteSegment("hello"); err != nil {
+		t.Fatalf("DeleteSegment() error: %v", err)
+	}
+
+	if lfs.offset <= offset {
+		t.Error("DeleteSegment() did not append a tombstone record")
+	}
+
+	_, err = lfs.FetchSegment("hello")
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	err = lfs.DeleteSegment("hello")
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("DeleteSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	// 被删除的记录和删除标记都是垃圾数据
+	if stat := lfs.stats[lfs.regionID]; stat.garbage != stat.size {
+		t.Errorf("region garbage = %d, want %d", stat.garbage, stat.size)
+	}
+}
+
+func TestLogStructuredFS_FullKeys(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	for _, key := range []string{"user:1", "user:2", "order:1"} {
+		if err := lfs.PutSegment(key, newTestSegment(key)); err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	keys := lfs.Keys()
+	sort.Strings(keys)
+	if want := []string{"order:1", "user:1", "user:2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+
+	// 索引指向了其他 key 的记录时必须校验失败，而不是返回错误的数据
+	inode, _ := lfs.GetINode("user:2")
+	lfs.AddINode("user:1", inode)
+
+	_, err := lfs.FetchSegment("user:1")
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrKeyMismatch)
+	}
+}
+
+func TestOpenFS_Instances(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+
+	lfs1 := openTestFS(t, dir1)
+	lfs2 := openTestFS(t, dir2)
+	defer lfs2.CloseFS()
+
+	if lfs1 == lfs2 || lfs1.path != dir1 || lfs2.path != dir2 {
+		t.Fatal("OpenFS() should return independent instances")
+	}
+
+	if err := lfs1.PutSegment("hello", newTestSegment("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lfs2.FetchSegment("hello"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment() = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	// 同一个数据目录不能被重复打开
+	if _, err := OpenFS(dir1, nil); !errors.Is(err, ErrLocked) {
+		t.Errorf("OpenFS() = %v, want %v", err, ErrLocked)
+	}
+
+	if _, err := OpenFS(t.TempDir(), &Options{Mode: "unknown"}); err == nil {
+		t.Error("OpenFS() should reject invalid options")
+	}
+
+	if err := lfs1.CloseFS(); err != nil {
+		t.Fatalf("CloseFS() error: %v", err)
+	}
+	lfs1 = openTestFS(t, dir1)
+	defer lfs1.CloseFS()
+	if _, err := lfs1.FetchSegment("hello"); err != nil {
+		t.Errorf("FetchSegment() error: %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/auula/vasedb/conf"
+)
+
+var (
+	// 每次淘汰时抽样比较的 key 数量
+	evictSamples = 16
+
+	// ErrMemoryLimit is returned when a segment is larger than the memory limit
+	ErrMemoryLimit = errors.New("segment exceeds the memory limit")
+)
+
+// MemoryOptions configures a MemoryStorage.
+type MemoryOptions struct {
+	MaxMemory int64  // Memory limit in bytes, 0 means unlimited
+	Eviction  string // conf.EvictLRU or conf.EvictLFU
+}
+
+// NewMemoryOptions builds memory storage options from a server configuration.
+func NewMemoryOptions(opt *conf.ServerConfig) *MemoryOptions {
+	return &MemoryOptions{
+		MaxMemory: opt.Memory.MaxMemory * 1024 * 1024,
+		Eviction:  opt.Memory.Eviction,
+	}
+}
+
+type memoryEntry struct {
+	seg        *Segment
+	size       int64
+	lastAccess uint64 // Logical clock of the latest access
+	hits       uint64 // Number of accesses
+}
+
+// MemoryStorage keeps segments purely in memory with the same TTL and delete semantics
+// as LogStructuredFS, and evicts segments by LRU or LFU when the memory limit is reached.
+type MemoryStorage struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	keys      *skiplist // Ordered keys for range and prefix scans
+	used      int64     // Encoded size of all segments in bytes
+	maxMemory int64
+	eviction  string
+	clock     uint64
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewMemoryStorage returns an empty memory storage, nil opts means no memory limit.
+func NewMemoryStorage(opts *MemoryOptions) (*MemoryStorage, error) {
+	if opts == nil {
+		opts = new(MemoryOptions)
+	}
+	if opts.MaxMemory < 0 {
+		return nil, fmt.Errorf("max memory %d is negative", opts.MaxMemory)
+	}
+	if !conf.ValidEviction(opts.Eviction) {
+		return nil, fmt.Errorf("unsupported eviction policy %q", opts.Eviction)
+	}
+
+	ms := &MemoryStorage{
+		entries:   make(map[string]*memoryEntry),
+		keys:      newSkiplist(),
+		maxMemory: opts.MaxMemory,
+		eviction:  opts.Eviction,
+		closed:    make(chan struct{}),
+	}
+
+	ms.wg.Add(1)
+	go ms.runSweeper()
+
+	return ms, nil
+}
+
+// runSweeper 周期性地主动删除过期的 segment
+func (ms *MemoryStorage) runSweeper() {
+	defer ms.wg.Done()
+
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.closed:
+			return
+		case <-ticker.C:
+			ms.sweepExpired()
+		}
+	}
+}
+
+// cloneSegment 复制 segment，存储的数据不会被调用者修改
+func cloneSegment(seg *Segment) *Segment {
+	clone := *seg
+	clone.data = append([]byte(nil), seg.data...)
+	return &clone
+}
+
+// PutSegment stores a copy of seg under key.
+func (ms *MemoryStorage) PutSegment(key string, seg *Segment) error {
+	if key == "" {
+		return errors.New("segment key is empty")
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stored := cloneSegment(seg)
+	stored.key = key
+	stored.createdAt = time.Now().UnixNano()
+	size := int64(stored.recordSize())
+	if ms.maxMemory > 0 && size > ms.maxMemory {
+		return ErrMemoryLimit
+	}
+
+	ms.store(key, stored, size)
+
+	return nil
+}
+
+// store 写入 segment，超过内存限制时先淘汰其他的 segment，调用者需要持有锁
+func (ms *MemoryStorage) store(key string, seg *Segment, size int64) {
+	ms.remove(key)
+	ms.reserve(size, nil)
+	ms.insert(key, seg, size)
+}
+
+// reserve 淘汰 segment 直到可以再写入 size 字节，不会淘汰 keep 中的 key，调用者需要持有锁
+func (ms *MemoryStorage) reserve(size int64, keep map[string]struct{}) {
+	for ms.maxMemory > 0 && ms.used+size > ms.maxMemory {
+		if !ms.evict(keep) {
+			return
+		}
+	}
+}
+
+// insert 写入 segment，不检查内存限制，调用者需要持有锁并且已经删除了 key 原来的 segment
+func (ms *MemoryStorage) insert(key string, seg *Segment, size int64) {
+	ms.clock++
+	ms.entries[key] = &memoryEntry{seg: seg, size: size, lastAccess: ms.clock, hits: 1}
+	ms.keys.Insert(key)
+	ms.used += size
+}
+
+// remove 删除 key 对应的 segment，调用者需要持有锁
+func (ms *MemoryStorage) remove(key string) bool {
+	entry, ok := ms.entries[key]
+	if !ok {
+		return false
+	}
+	delete(ms.entries, key)
+	ms.keys.Delete(key)
+	ms.used -= entry.size
+	return true
+}
+
+// evict 抽样淘汰一个不在 keep 中的 segment，优先淘汰已经过期的，没有可以淘汰的 segment 时返回 false，
+// 调用者需要持有锁
+func (ms *MemoryStorage) evict(keep map[string]struct{}) bool {
+	now := time.Now().UnixNano()
+
+	var victim string
+	var candidate *memoryEntry
+	sampled := 0
+
+	// map 的遍历顺序是随机的，可以作为随机抽样
+	for key, entry := range ms.entries {
+		if _, ok := keep[key]; ok {
+			continue
+		}
+		if entry.seg.expired(now) {
+			candidate = entry
+			victim = key
+			break
+		}
+		if candidate == nil || ms.colder(entry, candidate) {
+			victim, candidate = key, entry
+		}
+		if sampled++; sampled >= evictSamples {
+			break
+		}
+	}
+
+	if candidate == nil {
+		return false
+	}
+	return ms.remove(victim)
+}
+
+// colder 判断 a 是否比 b 更应该被淘汰
+func (ms *MemoryStorage) colder(a, b *memoryEntry) bool {
+	if ms.eviction == conf.EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastAccess < b.lastAccess
+}
+
+// lookup 返回未过期的 segment 并记录访问，过期的 segment 直接删除，调用者需要持有锁
+func (ms *MemoryStorage) lookup(key string) (*memoryEntry, bool) {
+	entry, ok := ms.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if entry.seg.expired(time.Now().UnixNano()) {
+		ms.remove(key)
+		return nil, false
+	}
+
+	ms.clock++
+	entry.lastAccess = ms.clock
+	entry.hits++
+
+	return entry, true
+}
+
+// FetchSegment returns a copy of the segment stored under key.
+func (ms *MemoryStorage) FetchSegment(key string) (*Segment, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.lookup(key)
+	if !ok {
+		return nil, ErrSegmentNotFound
+	}
+
+	return cloneSegment(entry.seg), nil
+}
+
+// DeleteSegment removes the segment stored under key.
+func (ms *MemoryStorage) DeleteSegment(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.lookup(key); !ok {
+		return ErrSegmentNotFound
+	}
+	ms.remove(key)
+
+	return nil
+}
+
+// BatchINodes applies all operations of wb atomically.
+func (ms *MemoryStorage) BatchINodes(wb *WriteBatch) error {
+	if wb.Len() == 0 {
+		return ErrEmptyBatch
+	}
+
+	// 同一个 key 只保留最后一个操作，批量写入之后留下的 segment 必须能够同时放入内存
+	final := make(map[string]*Segment, wb.Len())
+	for _, seg := range wb.segments {
+		if seg.key == "" {
+			return errors.New("segment key is empty")
+		}
+		final[seg.key] = seg
+	}
+	var size int64
+	for _, seg := range final {
+		if !seg.IsTombstone() {
+			size += int64(seg.recordSize())
+		}
+	}
+	if ms.maxMemory > 0 && size > ms.maxMemory {
+		return ErrMemoryLimit
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// 先删除批量写入涉及的全部 key，再只淘汰批量写入之外的 segment，写入过程中不会淘汰本批的 key
+	keep := make(map[string]struct{}, len(final))
+	for key := range final {
+		keep[key] = struct{}{}
+		ms.remove(key)
+	}
+	ms.reserve(size, keep)
+
+	now := time.Now().UnixNano()
+	for _, seg := range wb.segments {
+		if final[seg.key] != seg || seg.IsTombstone() {
+			continue
+		}
+		stored := cloneSegment(seg)
+		stored.createdAt = now
+		ms.insert(seg.key, stored, int64(stored.recordSize()))
+	}
+
+	return nil
+}
+
+// TTL returns the remaining time to live of the segment stored under key.
+func (ms *MemoryStorage) TTL(key string) (time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.lookup(key)
+	if !ok {
+		return 0, ErrSegmentNotFound
+	}
+
+	if entry.seg.expiredAt == 0 {
+		return NoExpiration, nil
+	}
+
+	return time.Until(time.Unix(0, entry.seg.expiredAt)), nil
+}
+
+// ExpireSegment sets the time to live of the segment stored under key,
+// a non-positive ttl removes the expiration like PersistSegment.
+func (ms *MemoryStorage) ExpireSegment(key string, ttl time.Duration) error {
+	var expiredAt int64
+	if ttl > 0 {
+		expiredAt = time.Now().Add(ttl).UnixNano()
+	}
+	return ms.setExpiration(key, expiredAt)
+}
+
+// PersistSegment removes the expiration of the segment stored under key.
+func (ms *MemoryStorage) PersistSegment(key string) error {
+	return ms.setExpiration(key, 0)
+}
+
+func (ms *MemoryStorage) setExpiration(key string, expiredAt int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.lookup(key)
+	if !ok {
+		return ErrSegmentNotFound
+	}
+	entry.seg.expiredAt = expiredAt
+
+	return nil
+}
+
+// Keys returns all unexpired keys in no particular order.
+func (ms *MemoryStorage) Keys() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	keys := make([]string, 0, len(ms.entries))
+	for key, entry := range ms.entries {
+		if !entry.seg.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Iterator returns an iterator over the keys in [start, end), an empty end is unbounded.
+func (ms *MemoryStorage) Iterator(start, end string) *Iterator {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return newIterator(ms.keys, start, end, ms.alive, ms.FetchSegment)
+}
+
+// Prefix returns an iterator over the keys starting with prefix.
+func (ms *MemoryStorage) Prefix(prefix string) *Iterator {
+	return ms.Iterator(prefix, prefixEnd(prefix))
+}
+
+// alive 判断 key 是否存在并且没有过期，不计入访问记录
+func (ms *MemoryStorage) alive(key string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.entries[key]
+	return ok && !entry.seg.expired(time.Now().UnixNano())
+}
+
+// sweepExpired 抽样检查并删除已经过期的 segment
+func (ms *MemoryStorage) sweepExpired() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for {
+		now := time.Now().UnixNano()
+		sampled, expired := 0, make([]string, 0)
+
+		for key, entry := range ms.entries {
+			if sampled >= expireSamples {
+				break
+			}
+			sampled++
+			if entry.seg.expired(now) {
+				expired = append(expired, key)
+			}
+		}
+
+		for _, key := range expired {
+			ms.remove(key)
+		}
+
+		if sampled == 0 || float64(len(expired)) < float64(sampled)*expireRepeatRatio {
+			return
+		}
+	}
+}
+
+// CloseFS stops the background sweeper and drops all segments.
+func (ms *MemoryStorage) CloseFS() error {
+	select {
+	case <-ms.closed:
+		return errors.New("memory storage already closed")
+	default:
+		close(ms.closed)
+	}
+
+	ms.wg.Wait()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.entries = make(map[string]*memoryEntry)
+	ms.keys = newSkiplist()
+	ms.used = 0
+
+	return nil
+}
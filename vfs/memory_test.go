@@ -0,0 +1,182 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func newTestMemoryStorage(t *testing.T, opts *MemoryOptions) *MemoryStorage {
+	t.Helper()
+
+	ms, err := NewMemoryStorage(opts)
+	if err != nil {
+		t.Fatalf("NewMemoryStorage() error: %v", err)
+	}
+	t.Cleanup(func() { ms.CloseFS() })
+
+	return ms
+}
+
+func TestMemoryStorage_Segments(t *testing.T) {
+	ms := newTestMemoryStorage(t, nil)
+
+	seg := newTestSegment("world")
+	if err := ms.PutSegment("hello", seg); err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+
+	// 存储的是副本，调用者修改数据不会影响存储
+	seg.data[0] = 'W'
+	got, err := ms.FetchSegment("hello")
+	if err != nil || string(got.data) != "world" || got.kind != Text {
+		t.Fatalf("FetchSegment() = %v, %v", got, err)
+	}
+
+	wb := NewWriteBatch()
+	wb.Put("foo", newTestSegment("bar"))
+	wb.Delete("hello")
+	if err := ms.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+
+	if _, err := ms.FetchSegment("hello"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(hello) = %v, want %v", err, ErrSegmentNotFound)
+	}
+	if err := ms.DeleteSegment("hello"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("DeleteSegment(hello) = %v, want %v", err, ErrSegmentNotFound)
+	}
+	if keys := ms.Keys(); len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("Keys() = %v, want [foo]", keys)
+	}
+}
+
+func TestMemoryStorage_TTL(t *testing.T) {
+	ms := newTestMemoryStorage(t, nil)
+
+	ms.PutSegment("hello", newTestSegment("world"))
+	if ttl, err := ms.TTL("hello"); err != nil || ttl != NoExpiration {
+		t.Errorf("TTL() = %v, %v, want %v", ttl, err, NoExpiration)
+	}
+
+	if err := ms.ExpireSegment("hello", time.Minute); err != nil {
+		t.Fatalf("ExpireSegment() error: %v", err)
+	}
+	if ttl, _ := ms.TTL("hello"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL() = %v, want (0, 1m]", ttl)
+	}
+
+	if err := ms.PersistSegment("hello"); err != nil {
+		t.Fatalf("PersistSegment() error: %v", err)
+	}
+	if ttl, _ := ms.TTL("hello"); ttl != NoExpiration {
+		t.Errorf("TTL() = %v, want %v", ttl, NoExpiration)
+	}
+
+	expired := newTestSegment("value")
+	expired.SetTTL(time.Millisecond)
+	ms.PutSegment("expired", expired)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := ms.FetchSegment("expired"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(expired) = %v, want %v", err, ErrSegmentNotFound)
+	}
+	if err := ms.ExpireSegment("expired", time.Minute); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("ExpireSegment(expired) = %v, want %v", err, ErrSegmentNotFound)
+	}
+}
+
+func TestMemoryStorage_Eviction(t *testing.T) {
+	record := newTestSegment("value")
+	record.key = "key-0"
+	size := int64(record.recordSize())
+
+	tests := []struct {
+		eviction string
+		want     []string
+	}{
+		// key-1 最久没有被访问
+		{conf.EvictLRU, []string{"key-0", "key-2", "key-3"}},
+		// key-1 被访问的次数最多，key-0 和 key-2 次数相同时淘汰更久没有访问的 key-0
+		{conf.EvictLFU, []string{"key-1", "key-2", "key-3"}},
+	}
+
+	for _, tt := range tests {
+		ms := newTestMemoryStorage(t, &MemoryOptions{MaxMemory: 3 * size, Eviction: tt.eviction})
+
+		for i := 0; i < 3; i++ {
+			ms.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+		}
+		for i := 0; i < 3; i++ {
+			ms.FetchSegment("key-1")
+		}
+		ms.FetchSegment("key-0")
+		ms.FetchSegment("key-2")
+
+		if err := ms.PutSegment("key-3", newTestSegment("value")); err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+
+		keys := ms.Keys()
+		sort.Strings(keys)
+		if fmt.Sprint(keys) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: Keys() = %v, want %v", tt.eviction, keys, tt.want)
+		}
+		if ms.used > ms.maxMemory {
+			t.Errorf("%s: used memory %d exceeds limit %d", tt.eviction, ms.used, ms.maxMemory)
+		}
+	}
+
+	ms := newTestMemoryStorage(t, &MemoryOptions{MaxMemory: size})
+	if err := ms.PutSegment("large", newTestSegment("a much larger value")); !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("PutSegment() = %v, want %v", err, ErrMemoryLimit)
+	}
+}
+
+func TestMemoryStorage_BatchEviction(t *testing.T) {
+	record := newTestSegment("value")
+	record.key = "key-0"
+	size := int64(record.recordSize())
+
+	ms := newTestMemoryStorage(t, &MemoryOptions{MaxMemory: 3 * size, Eviction: conf.EvictLFU})
+	for i := 0; i < 3; i++ {
+		ms.PutSegment(fmt.Sprintf("old-%d", i), newTestSegment("value"))
+		for j := 0; j < 3; j++ {
+			ms.FetchSegment(fmt.Sprintf("old-%d", i))
+		}
+	}
+
+	// 批量写入的 key 访问次数最少，但是不能淘汰同一批写入的 key
+	wb := NewWriteBatch()
+	for i := 0; i < 3; i++ {
+		wb.Put(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+	}
+	if err := ms.BatchINodes(wb); err != nil {
+		t.Fatalf("BatchINodes() error: %v", err)
+	}
+
+	keys := ms.Keys()
+	sort.Strings(keys)
+	if want := []string{"key-0", "key-1", "key-2"}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+	if ms.used > ms.maxMemory {
+		t.Errorf("used memory %d exceeds limit %d", ms.used, ms.maxMemory)
+	}
+
+	// 整批超过内存限制时不写入任何 segment
+	wb = NewWriteBatch()
+	for i := 0; i < 4; i++ {
+		wb.Put(fmt.Sprintf("new-%d", i), newTestSegment("value"))
+	}
+	if err := ms.BatchINodes(wb); !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("BatchINodes() = %v, want %v", err, ErrMemoryLimit)
+	}
+	if keys := ms.Keys(); len(keys) != 3 {
+		t.Errorf("Keys() after rejected batch = %v, want 3 keys", keys)
+	}
+}
@@ -0,0 +1,130 @@
+package vfs
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/auula/vasedb/clog"
+)
+
+// mmapRegion 是数据文件的只读内存映射，活跃数据文件增长之后读取时会重新映射。
+// 数据文件的写入依然通过文件描述符完成，共享映射和文件共用同一份页缓存。
+type mmapRegion struct {
+	mu   sync.RWMutex
+	file File
+	fd   uintptr
+	data []byte
+}
+
+// fileDescriptor 是操作系统文件提供的文件描述符
+type fileDescriptor interface {
+	Fd() uintptr
+}
+
+func newMmapRegion(file File) (*mmapRegion, error) {
+	f, ok := file.(fileDescriptor)
+	if !ok {
+		return nil, errors.New("file has no descriptor to mmap")
+	}
+
+	m := &mmapRegion{file: file, fd: f.Fd()}
+	if err := m.remap(0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeAt 直接从映射的内存中解码记录，只有 value 会被复制
+func (m *mmapRegion) decodeAt(offset int64, length int, aead cipher.AEAD) (*Segment, error) {
+	end := offset + int64(length)
+
+	m.mu.RLock()
+	if end > int64(len(m.data)) {
+		m.mu.RUnlock()
+		if err := m.remap(end); err != nil {
+			return nil, err
+		}
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+
+	if end > int64(len(m.data)) {
+		return nil, ErrTruncatedRecord
+	}
+
+	return decodeRecord(m.data[offset:end], aead)
+}
+
+// remap 在映射长度小于 size 时按照文件当前的大小重新映射
+func (m *mmapRegion) remap(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size > 0 && size <= int64(len(m.data)) {
+		return nil
+	}
+
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == int64(len(m.data)) {
+		return nil
+	}
+
+	data, err := mmapFile(m.fd, int(info.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to mmap region: %w", err)
+	}
+
+	if m.data != nil {
+		if err := munmapFile(m.data); err != nil {
+			munmapFile(data)
+			return fmt.Errorf("failed to munmap region: %w", err)
+		}
+	}
+	m.data = data
+
+	return nil
+}
+
+func (m *mmapRegion) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		return nil
+	}
+
+	err := munmapFile(m.data)
+	m.data = nil
+	return err
+}
+
+// mapRegion 在 mmap 模式下映射数据文件，映射失败时回退到 pread，调用者需要持有写锁
+func (lfs *LogStructuredFS) mapRegion(id uint16, file File) {
+	if !lfs.mmap {
+		return
+	}
+
+	m, err := newMmapRegion(file)
+	if err != nil {
+		clog.Warnf("Falling back to pread for region %d: %v", id, err)
+		return
+	}
+
+	lfs.mmaps[id] = m
+}
+
+// unmapRegion 解除数据文件的映射，调用者需要持有写锁
+func (lfs *LogStructuredFS) unmapRegion(id uint16) error {
+	m, ok := lfs.mmaps[id]
+	if !ok {
+		return nil
+	}
+
+	delete(lfs.mmaps, id)
+	return m.close()
+}
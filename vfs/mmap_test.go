@@ -0,0 +1,62 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestMmapRegion_Read(t *testing.T) {
+	opts := NewOptions(conf.Default)
+	opts.Mode = conf.ModeMmap
+
+	dir := t.TempDir()
+	lfs := openTestFSWith(t, dir, opts)
+	lfs.regionThreshold = 256
+
+	// 写入之后立即读取，活跃数据文件的映射需要随着文件增长重新映射
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i%8)
+		if err := lfs.PutSegment(key, newTestSegment(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+		seg, err := lfs.FetchSegment(key)
+		if err != nil {
+			t.Fatalf("FetchSegment(%s) error: %v", key, err)
+		}
+		if want := fmt.Sprintf("value-%d", i); string(seg.data) != want {
+			t.Errorf("FetchSegment(%s) = %s, want %s", key, seg.data, want)
+		}
+	}
+
+	if len(lfs.mmaps) != len(lfs.regions)+1 {
+		t.Errorf("mapped %d regions, want %d", len(lfs.mmaps), len(lfs.regions)+1)
+	}
+
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+
+	check := func(lfs *LogStructuredFS) {
+		for i := 12; i < 20; i++ {
+			key := fmt.Sprintf("key-%d", i%8)
+			seg, err := lfs.FetchSegment(key)
+			if err != nil {
+				t.Fatalf("FetchSegment(%s) error: %v", key, err)
+			}
+			if want := fmt.Sprintf("value-%d", i); string(seg.data) != want {
+				t.Errorf("FetchSegment(%s) = %s, want %s", key, seg.data, want)
+			}
+		}
+	}
+
+	check(lfs)
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatalf("CloseFS() error: %v", err)
+	}
+
+	lfs = openTestFSWith(t, dir, opts)
+	defer lfs.CloseFS()
+	check(lfs)
+}
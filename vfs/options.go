@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/auula/vasedb/conf"
+)
+
+// Options configures a LogStructuredFS instance opened by OpenFS.
+type Options struct {
+	FileSystem         FileSystem    // File system of the data directory, nil uses OSFileSystem
+	RegionSize         int64         // Maximum size of a region in bytes
+	Mode               string        // Read and write mode, see conf.ValidMode
+	Sync               string        // Durability policy, see conf.ParseSync
+	Compaction         bool          // Run the compressor in the background
+	CompactionInterval time.Duration // Interval between compaction cycles
+	GarbageThreshold   float64       // Garbage ratio of a region to compact
+	IndexShards        int           // Number of index shards, a power of two, 0 picks one by GOMAXPROCS
+	AdaptiveShards     bool          // Double the index shards online under lock contention
+	Codec              string        // Compression codec of record values, see conf.ValidCodec
+	CompressMinSize    int           // Values smaller than this in bytes are not compressed
+	Encryption         bool          // Encrypt regions and index snapshots with AES-GCM
+	KeyFile            string        // File of encryption keys in "<id>:<hex key>" lines
+	KeyEnv             string        // Environment variable of encryption keys, takes precedence over KeyFile
+	Scrub              bool          // Verify the checksums of sealed regions in the background
+	ScrubInterval      time.Duration // Interval between two passes over all sealed regions
+	ScrubRate          int64         // Maximum read rate of the scrubber in bytes per second
+}
+
+// NewOptions builds options from a server configuration.
+func NewOptions(opt *conf.ServerConfig) *Options {
+	return &Options{
+		RegionSize:         opt.Region * 1024,
+		Mode:               opt.Mode,
+		Sync:               opt.Sync,
+		Compaction:         opt.Compressor.Enable,
+		CompactionInterval: time.Duration(opt.Compressor.Second) * time.Second,
+		GarbageThreshold:   opt.Compressor.Threshold,
+		IndexShards:        opt.Index.Shards,
+		AdaptiveShards:     opt.Index.Adaptive,
+		Codec:              opt.Compression.Codec,
+		CompressMinSize:    opt.Compression.MinSize,
+		Encryption:         opt.Encryption.Enable,
+		KeyFile:            opt.Encryption.KeyFile,
+		KeyEnv:             opt.Encryption.KeyEnv,
+		Scrub:              opt.Scrubber.Enable,
+		ScrubInterval:      time.Duration(opt.Scrubber.Second) * time.Second,
+		ScrubRate:          opt.Scrubber.Rate * 1024,
+	}
+}
+
+// validate 检查配置项，并为未设置的配置项填充默认值
+func (opts *Options) validate() error {
+	if opts.FileSystem == nil {
+		opts.FileSystem = OSFileSystem
+	}
+	if opts.RegionSize <= 0 {
+		opts.RegionSize = defaultRegionThreshold
+	}
+	if opts.RegionSize < maxRegionHeaderSize+recordHeaderSize {
+		return fmt.Errorf("region size %d is too small", opts.RegionSize)
+	}
+	// INode 中的偏移量只有 32 位
+	if opts.RegionSize > math.MaxUint32 {
+		return fmt.Errorf("region size %d exceeds the limit of %d bytes", opts.RegionSize, uint32(math.MaxUint32))
+	}
+	if !conf.ValidMode(opts.Mode) {
+		return fmt.Errorf("unsupported read mode %q", opts.Mode)
+	}
+	if _, _, err := conf.ParseSync(opts.Sync); err != nil {
+		return err
+	}
+	if opts.GarbageThreshold < 0 || opts.GarbageThreshold > 1 {
+		return fmt.Errorf("garbage threshold %v is out of range [0, 1]", opts.GarbageThreshold)
+	}
+	if _, err := parseCodec(opts.Codec); err != nil {
+		return err
+	}
+	if opts.CompressMinSize < 0 {
+		return fmt.Errorf("compression min size %d is negative", opts.CompressMinSize)
+	}
+	if opts.Encryption && opts.KeyFile == "" && opts.KeyEnv == "" {
+		return errors.New("encryption requires a key file or a key environment variable")
+	}
+	if opts.ScrubInterval <= 0 {
+		opts.ScrubInterval = defaultScrubInterval
+	}
+	if opts.ScrubRate < 0 {
+		return fmt.Errorf("scrub rate %d is negative", opts.ScrubRate)
+	}
+	if opts.ScrubRate == 0 {
+		opts.ScrubRate = defaultScrubRate
+	}
+	if opts.IndexShards == 0 {
+		opts.IndexShards = defaultIndexShards()
+	}
+	if !validShards(opts.IndexShards) {
+		return fmt.Errorf("index shards %d is not a power of two in [1, %d]", opts.IndexShards, maxIndexShards)
+	}
+	return nil
+}
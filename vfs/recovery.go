@@ -0,0 +1,337 @@
+package vfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+)
+
+// listRegions 返回数据目录中所有数据文件的 id，按照从小到大排序
+func listRegions(fsys FileSystem, path string) ([]uint16, error) {
+	names, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		if id, ok := parseRegionID(name); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// recoverRegions 按照 id 顺序扫描所有数据文件重建索引，没有封存的数据文件作为活跃数据文件，
+// 调用者需要持有写锁
+func (lfs *LogStructuredFS) recoverRegions() error {
+	ids, err := listRegions(lfs.fs, lfs.path)
+	if err != nil {
+		return err
+	}
+
+	// 清理数据压缩和快照过程中崩溃残留的临时文件
+	if err := removeTempFiles(lfs.fs, lfs.path); err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return lfs.createActiveRegion()
+	}
+
+	// 从索引快照恢复，只需要回放每个数据文件高水位之后的记录
+	marks := lfs.restoreIndexSnapshot(ids)
+
+	// 记录扫描过程中遇到的删除标记，防止更旧的记录被重新加入索引
+	tombs := make(map[string]int64)
+
+	activeID, ok, err := lfs.findActiveRegion(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		active := ok && id == activeID
+
+		flag := os.O_RDONLY
+		if active {
+			flag = os.O_RDWR
+		}
+
+		file, err := lfs.fs.OpenFile(filepath.Join(lfs.path, regionFileName(id)), flag, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open region file: %w", err)
+		}
+
+		stat := new(regionStat)
+		end, err := lfs.recoverRegion(id, file, active, marks[id], stat, tombs)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to recover region %d: %w", id, err)
+		}
+
+		stat.size = end - lfs.regionHeaders[id].size()
+		lfs.stats[id] = stat
+
+		lfs.mapRegion(id, file)
+
+		if active {
+			lfs.activeRegion = file
+			lfs.regionID = id
+			lfs.offset = end
+			lfs.openDirect()
+		} else {
+			lfs.regions[id] = file
+		}
+	}
+
+	lfs.rebuildRegionStats()
+
+	if !ok {
+		// 只剩下数据压缩生成的数据文件，创建新的活跃数据文件
+		if err := lfs.createActiveRegion(); err != nil {
+			return err
+		}
+	} else if header := lfs.regionHeaders[lfs.regionID]; header != newFileHeader(lfs.keyring.activeID()) {
+		// 开启加密、更换密钥或者升级格式之后，新的记录不能继续写入使用旧密钥或者其他格式的活跃数据文件
+		clog.Infof("Rotating region %d of format %s to format %s with encryption key %d",
+			lfs.regionID, header.version, currentFormat, lfs.keyring.activeID())
+		if err := lfs.rotateRegion(); err != nil {
+			return err
+		}
+	}
+
+	clog.Infof("Recovered %d regions of data directory %s", len(ids), lfs.path)
+
+	return nil
+}
+
+// findActiveRegion 返回活跃数据文件的 id。id 会被重复使用，不能根据大小判断写入顺序：滚动时先封存
+// 旧的活跃数据文件，所以没有封存的当前格式的数据文件就是活跃数据文件，文件头无法读取的数据文件可能是
+// 写入文件头时崩溃的活跃数据文件，交给 recoverRegion 处理。旧版本滚动时不封存数据文件，当时的 id 是递增的，
+// 选择 id 最大的一个并封存其余的。只有格式 1.0 的数据文件时选择 id 最大的一个
+func (lfs *LogStructuredFS) findActiveRegion(ids []uint16) (uint16, bool, error) {
+	var (
+		active, legacy       uint16
+		hasActive, hasLegacy bool
+		unsealed             []uint16
+	)
+	for _, id := range ids {
+		header, err := lfs.readRegionFileHeader(id)
+		switch {
+		case err != nil:
+			active, hasActive = id, true
+		case header.version == legacyFormat:
+			legacy, hasLegacy = id, true
+		case !header.sealed:
+			active, hasActive = id, true
+			unsealed = append(unsealed, id)
+		}
+	}
+
+	if !hasActive {
+		return legacy, hasLegacy, nil
+	}
+
+	for _, id := range unsealed {
+		if id == active {
+			continue
+		}
+		if err := lfs.sealRegionFile(id); err != nil {
+			return 0, false, fmt.Errorf("failed to seal region %d: %w", id, err)
+		}
+	}
+
+	return active, true, nil
+}
+
+// readRegionFileHeader 读取数据文件 id 的文件头
+func (lfs *LogStructuredFS) readRegionFileHeader(id uint16) (fileHeader, error) {
+	file, err := lfs.fs.OpenFile(filepath.Join(lfs.path, regionFileName(id)), os.O_RDONLY, 0)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer file.Close()
+	return readRegionHeader(file)
+}
+
+// sealRegionFile 在数据文件 id 的文件头中设置封存标记
+func (lfs *LogStructuredFS) sealRegionFile(id uint16) error {
+	file, err := lfs.fs.OpenFile(filepath.Join(lfs.path, regionFileName(id)), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	header, err := readRegionHeader(file)
+	if err == nil {
+		_, err = sealRegion(file, header)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recoverRegion 从 start 开始扫描单个数据文件并返回有效数据的末尾偏移量，
+// 活跃数据文件末尾因为崩溃产生的不完整记录会被截断
+func (lfs *LogStructuredFS) recoverRegion(id uint16, file File, active bool, start int64, stat *regionStat, tombs map[string]int64) (int64, error) {
+	header, err := readRegionHeader(file)
+
+	// 活跃数据文件在写入文件头时崩溃，重新写入文件头
+	if active && errors.Is(err, errShortHeader) {
+		clog.Warnf("Rewriting incomplete header of region %d", id)
+		if err := file.Truncate(0); err != nil {
+			return 0, err
+		}
+		header = newFileHeader(lfs.keyring.activeID())
+		if _, err := file.WriteAt(header.bytes(), 0); err != nil {
+			return 0, err
+		}
+		lfs.regionHeaders[id] = header
+		return header.size(), nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to validated file header: %w", err)
+	}
+	lfs.regionHeaders[id] = header
+
+	headerSize := header.size()
+	if start < headerSize {
+		start = headerSize
+	}
+
+	// 只有完整扫描的数据文件才能确定最旧记录的时间戳
+	if start > headerSize {
+		stat = nil
+	}
+
+	end, err := lfs.scanRegion(id, file, start, stat, tombs)
+	if err != nil {
+		if !active || !isCorrupted(err) {
+			return 0, err
+		}
+
+		if isPadding(file, end) {
+			clog.Infof("Truncating padded tail of region %d at offset %d", id, end)
+		} else {
+			clog.Warnf("Truncating torn tail of region %d at offset %d: %v", id, end, err)
+		}
+		if err := file.Truncate(end); err != nil {
+			return 0, fmt.Errorf("failed to truncate torn tail: %w", err)
+		}
+	}
+
+	return end, nil
+}
+
+// scanRegion 从 offset 开始顺序解码数据文件中的记录并回放到索引中，返回最后一条有效记录的末尾偏移量
+func (lfs *LogStructuredFS) scanRegion(id uint16, file File, offset int64, stat *regionStat, tombs map[string]int64) (int64, error) {
+	aead, err := lfs.regionCipher(id)
+	if err != nil {
+		return offset, err
+	}
+
+	reader := io.NewSectionReader(file, offset, math.MaxInt64-offset)
+	dec := NewDecoder(bufio.NewReader(reader))
+	dec.aead = aead
+	now := time.Now().UnixNano()
+
+	for {
+		seg, err := dec.Decode()
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		// 批次中的记录全部校验通过之后才会回放，损坏的批次整体作为残缺记录处理
+		entries, err := unpackRecord(offset, seg, aead)
+		if err != nil {
+			return offset, err
+		}
+
+		for _, entry := range entries {
+			if stat != nil && (stat.minCreated == 0 || entry.seg.createdAt < stat.minCreated) {
+				stat.minCreated = entry.seg.createdAt
+			}
+			lfs.replaySegment(id, entry.offset, entry.seg, now, tombs)
+		}
+
+		if seg.createdAt > lfs.lastCreated {
+			lfs.lastCreated = seg.createdAt
+		}
+		offset += int64(seg.recordSize())
+	}
+}
+
+// replaySegment 以最后写入为准将记录回放到索引中，删除标记和过期记录会移除索引
+func (lfs *LogStructuredFS) replaySegment(id uint16, offset int64, seg *Segment, now int64, tombs map[string]int64) {
+	if seg.createdAt > lfs.lastCreated {
+		lfs.lastCreated = seg.createdAt
+	}
+
+	key := seg.key
+
+	// 数据压缩之后旧记录可能出现在 id 更大的数据文件中，所以根据时间戳判断新旧
+	if ts, ok := tombs[key]; ok && ts > seg.createdAt {
+		return
+	}
+	if inode, ok := lfs.GetINode(key); ok && inode.CreatedTime.UnixNano() > seg.createdAt {
+		return
+	}
+
+	if seg.IsTombstone() || seg.expired(now) {
+		tombs[key] = seg.createdAt
+		lfs.removeINode(key)
+		return
+	}
+
+	lfs.AddINode(key, newINode(id, offset, seg))
+}
+
+// rebuildRegionStats 根据恢复之后的索引计算每个数据文件中的垃圾数据大小
+func (lfs *LogStructuredFS) rebuildRegionStats() {
+	live := make(map[uint16]int64, len(lfs.stats))
+	lfs.rangeShards(func(index map[string]*INode) {
+		for _, inode := range index {
+			live[inode.RegionID] += int64(inode.Length)
+		}
+	})
+
+	for id, stat := range lfs.stats {
+		stat.garbage = stat.size - live[id]
+	}
+}
+
+// removeTempFiles 删除数据目录中未完成的临时文件
+func removeTempFiles(fsys FileSystem, path string) error {
+	names, err := fsys.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, compactFileExtension) {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(path, name)); err != nil {
+			return fmt.Errorf("failed to remove temporary file: %w", err)
+		}
+		clog.Warnf("Removed unfinished temporary file %s", name)
+	}
+
+	return nil
+}
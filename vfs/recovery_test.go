@@ -0,0 +1,319 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestLogStructuredFS_Recover(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 128
+
+	for i := 0; i < 10; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i%5), newTestSegment(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	err := lfs.DeleteSegment("key-0")
+	if err != nil {
+		t.Fatalf("DeleteSegment() error: %v", err)
+	}
+
+	activeID, offset := lfs.regionID, lfs.offset
+	crashTestFS(lfs)
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if lfs.regionID != activeID || lfs.offset != offset {
+		t.Errorf("active region = %d@%d, want %d@%d", lfs.regionID, lfs.offset, activeID, offset)
+	}
+
+	// 最后写入的记录生效，删除标记移除了 key-0
+	_, err = lfs.FetchSegment("key-0")
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("FetchSegment(key-0) = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	for i := 1; i < 5; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("FetchSegment() error: %v", err)
+		}
+		if want := fmt.Sprintf("value-%d", i+5); string(seg.data) != want {
+			t.Errorf("FetchSegment(key-%d) = %s, want %s", i, seg.data, want)
+		}
+	}
+
+	// 恢复之后的写入时间戳必须大于已有记录
+	err = lfs.PutSegment("key-1", newTestSegment("latest"))
+	if err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+	seg, _ := lfs.FetchSegment("key-1")
+	if string(seg.data) != "latest" {
+		t.Errorf("FetchSegment(key-1) = %s, want latest", seg.data)
+	}
+}
+
+func TestLogStructuredFS_RecoverTornTail(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	for i := 0; i < 3; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	offset := lfs.offset
+	crashTestFS(lfs)
+
+	// 模拟崩溃时写入了一半的记录
+	torn := &Segment{kind: Text, key: "torn", data: []byte("value")}
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(1)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn.ToBytes()[:recordHeaderSize+2])
+	file.Close()
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if lfs.offset != offset {
+		t.Errorf("offset after recovery = %d, want %d", lfs.offset, offset)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, regionFileName(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != offset {
+		t.Errorf("region size after recovery = %d, want %d", info.Size(), offset)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("FetchSegment(key-%d) error: %v", i, err)
+		}
+	}
+}
+
+func TestLogStructuredFS_RecoverTornTailAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(conf.Default)
+	opts.Compaction = false
+	lfs := openTestFSWith(t, dir, opts)
+	lfs.regionThreshold = 256
+
+	// 第一个数据文件中只有 live 是存活的记录
+	if err := lfs.PutSegment("live", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lfs.PutSegment("key", newTestSegment(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lfs.compressor.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据压缩生成的数据文件 id 比活跃数据文件更大
+	lfs.mu.RLock()
+	active, compacted := lfs.regionID, uint16(0)
+	for id := range lfs.regions {
+		if id > compacted {
+			compacted = id
+		}
+	}
+	lfs.mu.RUnlock()
+	if compacted <= active {
+		t.Fatalf("compaction wrote region %d, want an id above active region %d", compacted, active)
+	}
+
+	if err := lfs.PutSegment("latest", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	offset := lfs.offset
+	crashTestFS(lfs)
+
+	// 模拟崩溃时写入了一半的记录
+	torn := &Segment{kind: Text, key: "torn", data: []byte("value")}
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(active)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn.ToBytes()[:recordHeaderSize+2])
+	file.Close()
+
+	lfs, err = OpenFS(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenFS() error: %v", err)
+	}
+	defer lfs.CloseFS()
+
+	if lfs.regionID != active || lfs.offset != offset {
+		t.Errorf("active region after recovery = %d at offset %d, want %d at offset %d", lfs.regionID, lfs.offset, active, offset)
+	}
+	for _, key := range []string{"live", "key", "latest"} {
+		if _, err := lfs.FetchSegment(key); err != nil {
+			t.Errorf("FetchSegment(%s) error: %v", key, err)
+		}
+	}
+}
+
+func TestLogStructuredFS_RecoverCorruptedSealedRegion(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 64
+
+	for i := 0; i < 3; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+	crashTestFS(lfs)
+
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(1)), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xFF, 0xFF}, regionHeaderSize(0)+recordHeaderSize)
+	file.Close()
+
+	if _, err := OpenFS(dir, nil); err == nil {
+		t.Error("OpenFS() should fail on corrupted sealed region")
+	}
+
+	// 打开失败时需要释放目录锁
+	lock, err := lockDir(OSFileSystem, dir)
+	if err != nil {
+		t.Fatalf("lockDir() error: %v", err)
+	}
+	lock.Close()
+}
+
+func TestLogStructuredFS_ReuseRegionIDs(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(conf.Default)
+	opts.Compaction = false
+	lfs := openTestFSWith(t, dir, opts)
+
+	rotate := func() uint16 {
+		lfs.mu.Lock()
+		defer lfs.mu.Unlock()
+		if err := lfs.rotateRegion(); err != nil {
+			t.Fatal(err)
+		}
+		return lfs.regionID
+	}
+
+	// region 1 中只有被覆盖的记录
+	if err := lfs.PutSegment("key", newTestSegment("old")); err != nil {
+		t.Fatal(err)
+	}
+	rotate()
+	if err := lfs.PutSegment("key", newTestSegment("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lfs.saveIndexSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 磁盘上的索引快照仍然引用 region 1，保存新的快照之前不能重复使用
+	if id := compactTestRegion(t, lfs, 1); id != 0 {
+		t.Fatalf("compactRegion(1) wrote region %d, want no live records", id)
+	}
+	if id := rotate(); id == 1 {
+		t.Fatal("rotateRegion() reused region 1 referenced by the index snapshot")
+	}
+	if err := lfs.saveIndexSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	active := rotate()
+	if active != 1 {
+		t.Fatalf("rotateRegion() allocated region %d, want the free region 1", active)
+	}
+
+	if err := lfs.PutSegment("latest", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	offset := lfs.offset
+	crashTestFS(lfs)
+
+	// 活跃数据文件的 id 比封存的数据文件更小，崩溃时写入了一半的记录
+	torn := &Segment{kind: Text, key: "torn", data: []byte("value")}
+	file, err := os.OpenFile(filepath.Join(dir, regionFileName(active)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn.ToBytes()[:recordHeaderSize+2])
+	file.Close()
+
+	lfs, err = OpenFS(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenFS() error: %v", err)
+	}
+	defer lfs.CloseFS()
+
+	if lfs.regionID != active || lfs.offset != offset {
+		t.Errorf("active region after recovery = %d at offset %d, want %d at offset %d", lfs.regionID, lfs.offset, active, offset)
+	}
+	if seg, err := lfs.FetchSegment("key"); err != nil || string(seg.data) != "new" {
+		t.Errorf("FetchSegment(key) = %v, %v, want new", seg, err)
+	}
+	if _, err := lfs.FetchSegment("latest"); err != nil {
+		t.Errorf("FetchSegment(latest) error: %v", err)
+	}
+}
+
+func TestLogStructuredFS_SealRotatedRegions(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	if err := lfs.PutSegment("key", newTestSegment("value")); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Lock()
+	if err := lfs.rotateRegion(); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Unlock()
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧版本滚动时不封存数据文件
+	name := filepath.Join(dir, regionFileName(1))
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(regionHeader(0), 0)
+	file.Close()
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	if lfs.regionID != 2 {
+		t.Errorf("active region = %d, want the largest unsealed region 2", lfs.regionID)
+	}
+
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, err := parseRegionHeader(buf, name); err != nil || !header.sealed || !lfs.regionHeaders[1].sealed {
+		t.Errorf("region 1 header = %+v, %v, want sealed after recovery", header, err)
+	}
+}
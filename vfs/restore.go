@@ -0,0 +1,334 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+// RestoreOptions configures point-in-time recovery of Restore. The sequence number of a record
+// is its CreatedTime in Unix nanoseconds, which strictly increases within a data directory.
+type RestoreOptions struct {
+	LogPath  string    // Directory of region files written after the backup, empty restores the backup only
+	Until    time.Time // Replay records created at or before this time, zero has no time limit
+	Sequence int64     // Replay records with a sequence number at most this, 0 has no limit
+}
+
+// RestoreStat is the result of Restore.
+type RestoreStat struct {
+	Files    int   `json:"files"`    // Number of files copied from the backup
+	Replayed int   `json:"replayed"` // Number of keys updated from the region logs
+	Sequence int64 `json:"sequence"` // Sequence number of the latest record in the restored directory
+}
+
+// Restore rebuilds the data directory at path from a backup, either a tar archive written by
+// Snapshot.WriteTo or a directory of copied region files, then replays the records of the regions
+// in ropts.LogPath which are newer than the backup up to the requested time or sequence number.
+// Records overwritten and compacted away in the log regions before the target time can not be replayed.
+func Restore(backup, path string, opts *Options, ropts *RestoreOptions) (*RestoreStat, error) {
+	if opts == nil {
+		opts = NewOptions(conf.Default)
+	}
+	if ropts == nil {
+		ropts = new(RestoreOptions)
+	}
+
+	// 恢复期间不运行数据压缩，日志中的记录还没有回放
+	o := *opts
+	o.Compaction = false
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid file system options: %w", err)
+	}
+
+	if names, err := o.FileSystem.ReadDir(path); err == nil && len(names) > 0 {
+		return nil, fmt.Errorf("restore target %s is not empty", path)
+	}
+	if err := o.FileSystem.MkdirAll(path, conf.FsPerm); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	stat := new(RestoreStat)
+	files, err := copyBackup(o.FileSystem, backup, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy backup: %w", err)
+	}
+	stat.Files = files
+
+	lfs, err := OpenFS(path, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	if ropts.LogPath != "" {
+		stat.Replayed, err = lfs.replayLogs(ropts.LogPath, ropts.limit())
+	}
+	stat.Sequence = lfs.lastCreated
+
+	if cerr := lfs.CloseFS(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay region logs, %s is incomplete: %w", path, err)
+	}
+
+	clog.Infof("Restored %s from %s with %d files and %d replayed keys up to sequence %d",
+		path, backup, stat.Files, stat.Replayed, stat.Sequence)
+
+	return stat, nil
+}
+
+// limit 返回可以回放的最大序列号
+func (ropts *RestoreOptions) limit() int64 {
+	limit := int64(math.MaxInt64)
+	if !ropts.Until.IsZero() {
+		limit = ropts.Until.UnixNano()
+	}
+	if ropts.Sequence > 0 && ropts.Sequence < limit {
+		limit = ropts.Sequence
+	}
+	return limit
+}
+
+// isBackupFile 判断备份中的文件是否需要恢复，只接受数据文件和索引快照
+func isBackupFile(name string) bool {
+	if _, ok := parseRegionID(name); ok {
+		return true
+	}
+	return name == indexSnapshotFile
+}
+
+// copyBackup 将 tar 文件或者目录中的数据文件和索引快照复制到 path，返回复制的文件数量
+func copyBackup(fsys FileSystem, backup, path string) (int, error) {
+	info, err := fsys.Stat(backup)
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		names, err := fsys.ReadDir(backup)
+		if err != nil {
+			return 0, err
+		}
+
+		files := 0
+		for _, name := range names {
+			if !isBackupFile(name) {
+				continue
+			}
+			err := copyFile(fsys, filepath.Join(backup, name), filepath.Join(path, name))
+			if err != nil {
+				return files, fmt.Errorf("failed to copy %s: %w", name, err)
+			}
+			files++
+		}
+		return files, fsys.SyncDir(path)
+	}
+
+	file, err := fsys.OpenFile(backup, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	files := 0
+	tr := tar.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, fsys.SyncDir(path)
+		}
+		if err != nil {
+			return files, err
+		}
+
+		// 只接受没有目录的文件名，防止写到数据目录之外
+		if hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != hdr.Name || !isBackupFile(hdr.Name) {
+			clog.Warnf("Skipping unexpected file %s in backup %s", hdr.Name, backup)
+			continue
+		}
+
+		if err := writeBackupFile(fsys, filepath.Join(path, hdr.Name), tr); err != nil {
+			return files, fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		files++
+	}
+}
+
+func copyFile(fsys FileSystem, src, dst string) error {
+	file, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeBackupFile(fsys, dst, io.NewSectionReader(file, 0, info.Size()))
+}
+
+// writeBackupFile 创建文件并写入 r 中的全部数据
+func writeBackupFile(fsys FileSystem, name string, r io.Reader) error {
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, conf.FsPerm)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	buf := make([]byte, 1<<20)
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := file.WriteAt(buf[:n], offset); werr != nil {
+				err = werr
+				break
+			}
+			offset += int64(n)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// replayLogs 扫描 logPath 中的数据文件，将备份之后并且序列号不超过 limit 的记录按照写入顺序回放，
+// 同一个 key 只需要回放最后一次写入，返回回放的 key 数量
+func (lfs *LogStructuredFS) replayLogs(logPath string, limit int64) (int, error) {
+	ids, err := listRegions(lfs.fs, logPath)
+	if err != nil {
+		return 0, err
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// 备份中最新记录的序列号，更旧的记录已经包含在备份中
+	base := lfs.lastCreated
+	latest := make(map[string]*Segment)
+	for _, id := range ids {
+		if err := lfs.scanLogRegion(filepath.Join(logPath, regionFileName(id)), base, limit, latest); err != nil {
+			return 0, fmt.Errorf("failed to scan region log %d: %w", id, err)
+		}
+	}
+
+	segs := make([]*Segment, 0, len(latest))
+	for _, seg := range latest {
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].createdAt < segs[j].createdAt
+	})
+
+	now := time.Now().UnixNano()
+	for _, seg := range segs {
+		if err := lfs.replayRecord(seg, now); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(segs), nil
+}
+
+// scanLogRegion 解码数据文件中序列号在 (base, limit] 之间的记录，保存每个 key 最新的记录。
+// 批次按照提交标记的序列号整体回放或者整体跳过，末尾不完整的记录被忽略
+func (lfs *LogStructuredFS) scanLogRegion(name string, base, limit int64, latest map[string]*Segment) error {
+	file, err := lfs.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readRegionHeader(file)
+	if err != nil {
+		return err
+	}
+	aead, err := lfs.keyring.aead(header.keyID)
+	if err != nil {
+		return err
+	}
+
+	offset := header.size()
+	dec := NewDecoder(bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset)))
+	dec.aead = aead
+
+	for {
+		seg, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if isCorrupted(err) {
+				clog.Warnf("Stopping replay of %s at damaged offset %d: %v", name, offset, err)
+				return nil
+			}
+			return err
+		}
+		start := offset
+		offset += int64(seg.recordSize())
+
+		if seg.createdAt <= base || seg.createdAt > limit {
+			continue
+		}
+
+		entries, err := unpackRecord(start, seg, aead)
+		if err != nil {
+			clog.Warnf("Skipping damaged batch in %s: %v", name, err)
+			continue
+		}
+		for _, entry := range entries {
+			if prev, ok := latest[entry.seg.key]; !ok || prev.createdAt < entry.seg.createdAt {
+				latest[entry.seg.key] = entry.seg
+			}
+		}
+	}
+}
+
+// replayRecord 保留原始序列号追加一条日志中的记录，过期的记录按照删除处理，调用者需要持有写锁
+func (lfs *LogStructuredFS) replayRecord(seg *Segment, now int64) error {
+	if seg.createdAt > lfs.lastCreated {
+		lfs.lastCreated = seg.createdAt
+	}
+
+	if seg.IsTombstone() || seg.expired(now) {
+		if _, ok := lfs.GetINode(seg.key); !ok {
+			return nil
+		}
+		tombstone := &Segment{kind: Binary, flags: flagTombstone, key: seg.key, createdAt: seg.createdAt}
+		inode, err := lfs.appendRecord(tombstone)
+		if err != nil {
+			return err
+		}
+		lfs.markGarbage(inode)
+		if old := lfs.removeINode(seg.key); old != nil {
+			lfs.markGarbage(old)
+		}
+		return nil
+	}
+
+	inode, err := lfs.appendRecord(seg)
+	if err != nil {
+		return err
+	}
+	if old := lfs.swapINode(seg.key, inode); old != nil {
+		lfs.markGarbage(old)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fetchTestValues 打开 dir 并读取 keys，不存在的 key 返回空字符串
+func fetchTestValues(t *testing.T, dir string, keys ...string) []string {
+	t.Helper()
+
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		if seg, err := lfs.FetchSegment(key); err == nil {
+			values[i] = string(seg.data)
+		}
+	}
+	return values
+}
+
+func TestRestore(t *testing.T) {
+	live := t.TempDir()
+	lfs := openTestFS(t, live)
+
+	for i := 0; i < 10; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := lfs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup.tar")
+	file, err := os.Create(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	snap.Close()
+
+	// 备份之后的写入，seq 是中间时间点的序列号
+	lfs.PutSegment("key-1", newTestSegment("v2"))
+	lfs.DeleteSegment("key-0")
+	wb := NewWriteBatch()
+	wb.Put("batch-0", newTestSegment("v1"))
+	wb.Put("batch-1", newTestSegment("v1"))
+	lfs.BatchINodes(wb)
+	seq := lfs.lastCreated
+
+	lfs.PutSegment("key-1", newTestSegment("v3"))
+	lfs.PutSegment("later", newTestSegment("v1"))
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"key-0", "key-1", "batch-1", "later"}
+	tests := []struct {
+		name  string
+		ropts *RestoreOptions
+		want  []string
+	}{
+		{"backup only", nil, []string{"v1", "v1", "", ""}},
+		{"sequence", &RestoreOptions{LogPath: live, Sequence: seq}, []string{"", "v2", "v1", ""}},
+		{"time", &RestoreOptions{LogPath: live, Until: time.Unix(0, seq)}, []string{"", "v2", "v1", ""}},
+		{"before batch", &RestoreOptions{LogPath: live, Sequence: seq - 1}, []string{"", "v2", "", ""}},
+		{"latest", &RestoreOptions{LogPath: live}, []string{"", "v3", "v1", "v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "restored")
+			if _, err := Restore(backup, dir, nil, tt.ropts); err != nil {
+				t.Fatalf("Restore() error: %v", err)
+			}
+
+			got := fetchTestValues(t, dir, keys...)
+			for i := range keys {
+				if got[i] != tt.want[i] {
+					t.Errorf("%s = %q, want %q", keys[i], got[i], tt.want[i])
+				}
+			}
+
+			// 恢复之后的目录也可以作为备份目录再次恢复
+			again := filepath.Join(t.TempDir(), "again")
+			if _, err := Restore(dir, again, nil, nil); err != nil {
+				t.Fatalf("Restore() from directory error: %v", err)
+			}
+			if got := fetchTestValues(t, again, keys...); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("values restored from directory = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Restore(backup, live, nil, nil); err == nil {
+		t.Error("Restore() into a non-empty directory should fail")
+	}
+}
@@ -0,0 +1,248 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+)
+
+var (
+	// 默认两次完整扫描之间的间隔
+	defaultScrubInterval = 24 * time.Hour
+	// 默认扫描速率，单位字节每秒
+	defaultScrubRate int64 = 4 << 20
+
+	errScrubStopped = errors.New("scrubber stopped")
+)
+
+// DamagedRegion is a sealed region in which the scrubber found a damaged record.
+type DamagedRegion struct {
+	ID          uint16    `json:"id"`
+	Offset      int64     `json:"offset"` // Offset of the first damaged record
+	Error       string    `json:"error"`
+	Quarantined bool      `json:"quarantined"` // Live records were salvaged and the region was moved aside
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// ScrubStat is the progress of the background scrubber since the file system was opened.
+type ScrubStat struct {
+	Passes   uint64          `json:"passes"`  // Number of completed passes over all sealed regions
+	Regions  uint64          `json:"regions"` // Number of verified regions
+	Bytes    uint64          `json:"bytes"`   // Number of verified bytes
+	LastPass time.Time       `json:"last_pass"`
+	Damaged  []DamagedRegion `json:"damaged"`
+}
+
+// scrubber 在后台按照限定的速率重新读取封存的数据文件并校验每条记录，
+// 发现损坏时复制存活的记录并隔离数据文件
+type scrubber struct {
+	lfs  *LogStructuredFS
+	rate int64 // Bytes per second, 0 is unlimited
+
+	mu   sync.Mutex
+	stat ScrubStat
+}
+
+func newScrubber(lfs *LogStructuredFS, rate int64) *scrubber {
+	return &scrubber{lfs: lfs, rate: rate, stat: ScrubStat{Damaged: []DamagedRegion{}}}
+}
+
+// Scrub verifies every sealed region once, damaged regions are quarantined.
+func (s *scrubber) Scrub() error {
+	lfs := s.lfs
+
+	lfs.mu.RLock()
+	ids := make([]uint16, 0, len(lfs.regions))
+	for id := range lfs.regions {
+		ids = append(ids, id)
+	}
+	lfs.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		size, offset, err := s.verifyRegion(id)
+		if errors.Is(err, errScrubStopped) {
+			return nil
+		}
+
+		s.mu.Lock()
+		s.stat.Regions++
+		s.stat.Bytes += uint64(size)
+		s.mu.Unlock()
+
+		if err == nil {
+			continue
+		}
+		if !isCorrupted(err) && !errors.Is(err, ErrDecryptFailed) {
+			return fmt.Errorf("failed to verify region %d: %w", id, err)
+		}
+
+		clog.Errorf("Scrubber found a damaged record in region %d at offset %d: %v", id, offset, err)
+		damaged := DamagedRegion{ID: id, Offset: offset, Error: err.Error(), DetectedAt: time.Now()}
+		damaged.Quarantined, err = s.quarantine(id)
+		if err != nil {
+			clog.Errorf("Failed to quarantine region %d: %v", id, err)
+		}
+
+		s.mu.Lock()
+		s.stat.Damaged = append(s.stat.Damaged, damaged)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.stat.Passes++
+	s.stat.LastPass = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// verifyRegion 限速顺序解码数据文件中的记录，返回校验的字节数和第一条损坏记录的偏移量。
+// 校验期间数据文件被固定，不会被数据压缩删除
+func (s *scrubber) verifyRegion(id uint16) (int64, int64, error) {
+	lfs := s.lfs
+
+	lfs.mu.Lock()
+	file, ok := lfs.regions[id]
+	header := lfs.regionHeaders[id]
+	if ok {
+		lfs.pins[id]++
+	}
+	lfs.mu.Unlock()
+	if !ok {
+		return 0, 0, nil
+	}
+
+	defer func() {
+		lfs.mu.Lock()
+		if lfs.pins[id]--; lfs.pins[id] <= 0 {
+			delete(lfs.pins, id)
+		}
+		lfs.mu.Unlock()
+	}()
+
+	aead, err := lfs.keyring.aead(header.keyID)
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r := &throttledReader{r: io.NewSectionReader(file, 0, info.Size()), rate: s.rate, start: time.Now(), closed: lfs.closed}
+	br := bufio.NewReader(r)
+
+	buf := make([]byte, header.size())
+	if _, err := io.ReadFull(br, buf); err != nil || !bytes.Equal(buf, header.bytes()) {
+		if errors.Is(err, errScrubStopped) {
+			return 0, 0, err
+		}
+		return r.n, 0, fmt.Errorf("%w: region header is damaged", ErrInvalidHeader)
+	}
+
+	dec := NewDecoder(br)
+	dec.aead = aead
+	offset := header.size()
+
+	for {
+		seg, err := dec.Decode()
+		if err == io.EOF {
+			return r.n, offset, nil
+		}
+		if err == nil {
+			_, err = unpackRecord(offset, seg, aead)
+		}
+		if err != nil {
+			return r.n, offset, err
+		}
+		offset += int64(seg.recordSize())
+	}
+}
+
+// quarantine 复制损坏的数据文件中校验通过的存活记录，然后将数据文件重命名为 .damaged，
+// 被备份快照固定的数据文件等到下一次扫描再处理
+func (s *scrubber) quarantine(id uint16) (bool, error) {
+	lfs := s.lfs
+
+	scan, err := scanRegionFile(lfs.fs, filepath.Join(lfs.path, regionFileName(id)), id, lfs.keyring)
+	if err != nil {
+		return false, err
+	}
+	if err := lfs.compressor.rewriteRegion(id, scan); err != nil {
+		return false, err
+	}
+
+	lfs.mu.RLock()
+	_, exists := lfs.regions[id]
+	lfs.mu.RUnlock()
+	if exists {
+		clog.Warnf("Region %d is pinned by a backup, quarantine is deferred to the next scrub", id)
+		return false, nil
+	}
+
+	// 被隔离的数据文件使旧的索引快照失效
+	return true, lfs.saveIndexSnapshot()
+}
+
+// ScrubStats returns the progress of the background scrubber and the damaged regions it found.
+func (lfs *LogStructuredFS) ScrubStats() ScrubStat {
+	s := lfs.scrubber
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := s.stat
+	stat.Damaged = append([]DamagedRegion{}, s.stat.Damaged...)
+	return stat
+}
+
+// throttledReader 将读取速率限制在 rate 字节每秒以内，文件系统关闭时返回 errScrubStopped
+type throttledReader struct {
+	r      io.Reader
+	rate   int64
+	start  time.Time
+	n      int64
+	closed <-chan struct{}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, errScrubStopped
+	default:
+	}
+
+	if t.rate <= 0 {
+		n, err := t.r.Read(p)
+		t.n += int64(n)
+		return n, err
+	}
+
+	// 每次最多读取一秒的配额，避免突发读取
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+
+	wait := time.Duration(float64(t.n)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-t.closed:
+			return n, errScrubStopped
+		case <-timer.C:
+		}
+	}
+
+	return n, err
+}
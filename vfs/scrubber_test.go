@@ -0,0 +1,142 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubber_Quarantine(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+	lfs.regionThreshold = 1024
+
+	for i := 0; i < 20; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment(strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := lfs.scrubber.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	stat := lfs.ScrubStats()
+	if stat.Passes != 1 || stat.Regions == 0 || len(stat.Damaged) != 0 {
+		t.Fatalf("ScrubStats() = %+v, want one clean pass", stat)
+	}
+
+	// 模拟封存的数据文件中出现位翻转
+	inode, _ := lfs.GetINode("key-1")
+	lfs.mu.RLock()
+	file := lfs.regions[inode.RegionID]
+	lfs.mu.RUnlock()
+	if _, err := file.(*os.File).WriteAt([]byte{0xFF}, int64(inode.Offset)+int64(inode.Length)-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lfs.scrubber.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	stat = lfs.ScrubStats()
+	if len(stat.Damaged) != 1 {
+		t.Fatalf("ScrubStats() damaged = %+v, want one region", stat.Damaged)
+	}
+	damaged := stat.Damaged[0]
+	if damaged.ID != inode.RegionID || damaged.Offset != int64(inode.Offset) || !damaged.Quarantined {
+		t.Errorf("damaged region = %+v, want region %d at offset %d quarantined", damaged, inode.RegionID, inode.Offset)
+	}
+
+	name := filepath.Join(dir, regionFileName(inode.RegionID))
+	if _, err := os.Stat(name + damagedFileExtension); err != nil {
+		t.Errorf("damaged region is not quarantined: %v", err)
+	}
+
+	// 损坏的 key 被删除，同一个数据文件中的其他 key 被复制到新的数据文件
+	for i := 0; i < 20; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if i == 1 {
+			if err == nil {
+				t.Error("damaged key-1 is still readable")
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(seg.data, []byte(strings.Repeat("v", 100))) {
+			t.Errorf("FetchSegment(key-%d) = %v, %v", i, seg, err)
+		}
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	r := &throttledReader{r: bytes.NewReader(make([]byte, 3000)), rate: 10000, start: time.Now(), closed: make(chan struct{})}
+
+	buf := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(r.start); elapsed < 250*time.Millisecond {
+		t.Errorf("reading 3000 bytes at 10000 B/s took %v", elapsed)
+	}
+
+	closed := make(chan struct{})
+	close(closed)
+	r = &throttledReader{r: bytes.NewReader(buf), rate: 1, start: time.Now(), closed: closed}
+	if _, err := r.Read(buf); err != errScrubStopped {
+		t.Errorf("Read() after close = %v, want %v", err, errScrubStopped)
+	}
+}
+
+func TestScrubber_QuarantineKeepsDeletion(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	lfs.regionThreshold = 256
+
+	// OLD 和 NEW 位于不同的封存数据文件中
+	if err := lfs.PutSegment("key", newTestSegment("OLD")); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Lock()
+	if err := lfs.rotateRegion(); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Unlock()
+	if err := lfs.PutSegment("key", newTestSegment("NEW")); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Lock()
+	if err := lfs.rotateRegion(); err != nil {
+		t.Fatal(err)
+	}
+	lfs.mu.Unlock()
+
+	inode, _ := lfs.GetINode("key")
+	lfs.mu.RLock()
+	file := lfs.regions[inode.RegionID]
+	lfs.mu.RUnlock()
+	if _, err := file.(*os.File).WriteAt([]byte{0xFF}, int64(inode.Offset)+int64(inode.Length)-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lfs.scrubber.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lfs.FetchSegment("key"); err != ErrSegmentNotFound {
+		t.Fatalf("FetchSegment(key) after quarantine = %v, want %v", err, ErrSegmentNotFound)
+	}
+
+	// 没有索引快照的完整扫描不能恢复更旧的记录
+	crashTestFS(lfs)
+	os.Remove(filepath.Join(dir, indexSnapshotFile))
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+	if seg, err := lfs.FetchSegment("key"); err != ErrSegmentNotFound {
+		t.Errorf("FetchSegment(key) after recovery = %v, %v, want %v", seg, err, ErrSegmentNotFound)
+	}
+}
@@ -2,6 +2,7 @@ package vfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/auula/vasedb/types"
 )
@@ -18,9 +19,17 @@ const (
 	Number
 )
 
+func (k Kind) valid() bool {
+	return k >= Set && k <= Number
+}
+
 type Segment struct {
-	kind Kind
-	data []byte
+	kind      Kind
+	flags     uint8
+	key       string
+	data      []byte
+	createdAt int64
+	expiredAt int64
 }
 
 type Serializable interface {
@@ -52,8 +61,9 @@ func NewSegment(data Serializable) (*Segment, error) {
 
 	// 如果类型不匹配，则返回错误
 	return &Segment{
-		kind: kind,
-		data: data.ToBytes(),
+		kind:      kind,
+		data:      data.ToBytes(),
+		createdAt: time.Now().UnixNano(),
 	}, nil
 }
 
@@ -65,9 +75,56 @@ func (s *Segment) Size() int {
 	return len(s.data)
 }
 
-func (s *Segment) ToBytes() []byte {
+// Key returns the key the segment was stored under
+func (s *Segment) Key() string {
+	return s.key
+}
+
+// IsTombstone reports whether the segment is a delete marker
+func (s *Segment) IsTombstone() bool {
+	return s.flags&flagTombstone != 0
+}
+
+// expired 判断 Segment 在 now 时刻是否已经过期
+func (s *Segment) expired(now int64) bool {
+	return s.expiredAt != 0 && s.expiredAt <= now
+}
+
+// recordSize 返回 Segment 编码之后的记录长度
+func (s *Segment) recordSize() int {
+	size := recordHeaderSize + len(s.key) + len(s.data)
+	if s.isEncrypted() {
+		size += sealOverhead
+	}
+	return size
+}
 
-	return []byte{}
+// SetTTL makes the segment expire ttl after now, a non-positive ttl never expires
+func (s *Segment) SetTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		s.expiredAt = 0
+		return
+	}
+	s.expiredAt = time.Now().Add(ttl).UnixNano()
+}
+
+// ExpiredTime returns the expiration time of the segment, zero if it never expires
+func (s *Segment) ExpiredTime() time.Time {
+	return unixTime(s.expiredAt)
+}
+
+// CreatedTime returns the time the segment was written
+func (s *Segment) CreatedTime() time.Time {
+	return time.Unix(0, s.createdAt)
+}
+
+// ToBytes 返回 Segment 编码后的完整磁盘记录，编码失败时返回 nil
+func (s *Segment) ToBytes() []byte {
+	buf, err := encodeSegment(s)
+	if err != nil {
+		return nil
+	}
+	return buf
 }
 
 func (s *Segment) ToSet() *types.Set {
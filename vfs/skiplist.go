@@ -0,0 +1,155 @@
+package vfs
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// 每一层节点晋升到上一层的概率为 1/4
+	skiplistBranching = 4
+)
+
+// skiplist 是按照字节序排列的有序 key 集合，和哈希分片一起维护，用于范围和前缀扫描
+type skiplist struct {
+	mu     sync.RWMutex
+	head   *skipNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (sl *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && sl.rand.Intn(skiplistBranching) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPrev 返回每一层中最后一个 key 小于 key 的节点
+func (sl *skiplist) findPrev(key string, prev []*skipNode) *skipNode {
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if prev != nil {
+			prev[i] = node
+		}
+	}
+	return node
+}
+
+// Insert 插入 key，key 已经存在时返回 false
+func (sl *skiplist) Insert(key string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	prev := make([]*skipNode, skiplistMaxLevel)
+	node := sl.findPrev(key, prev)
+	if next := node.next[0]; next != nil && next.key == key {
+		return false
+	}
+
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			prev[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	node = &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	sl.length++
+
+	return true
+}
+
+// Delete 删除 key，key 不存在时返回 false
+func (sl *skiplist) Delete(key string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	prev := make([]*skipNode, skiplistMaxLevel)
+	target := sl.findPrev(key, prev).next[0]
+	if target == nil || target.key != key {
+		return false
+	}
+
+	for i := 0; i < len(target.next); i++ {
+		prev[i].next[i] = target.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+
+	return true
+}
+
+// Ceiling 返回大于等于 key 的最小 key
+func (sl *skiplist) Ceiling(key string) (string, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	next := sl.findPrev(key, nil).next[0]
+	if next == nil {
+		return "", false
+	}
+	return next.key, true
+}
+
+// Lower 返回小于 key 的最大 key
+func (sl *skiplist) Lower(key string) (string, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	node := sl.findPrev(key, nil)
+	if node == sl.head {
+		return "", false
+	}
+	return node.key, true
+}
+
+// Last 返回最大的 key
+func (sl *skiplist) Last() (string, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == sl.head {
+		return "", false
+	}
+	return node.key, true
+}
+
+// Len 返回 key 的数量
+func (sl *skiplist) Len() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.length
+}
@@ -0,0 +1,311 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+// Index snapshot layout, all integers are big-endian:
+//
+//	+----------+-------------+-------------+------------------------+------------+---------+----------+
+//	| Metadata | LastCreated | RegionCount | Regions (ID, Size) ... | EntryCount | Entries | Checksum |
+//	| 4 bytes  | 8 bytes     | 2 bytes     | (2 + 8) * RegionCount  | 8 bytes    | ...     | 4 bytes  |
+//	+----------+-------------+-------------+------------------------+------------+---------+----------+
+//
+// Regions 记录了快照时每个数据文件已经写入索引的高水位，恢复时只需要回放高水位之后的记录。
+// 每个 Entry 为 KeySize(2) Key RegionID(2) Offset(4) Length(4) CreatedTime(8) ExpireTime(8)。
+const (
+	snapshotINodeSize = 26
+)
+
+var (
+	indexSnapshotFile = "index.snapshot"
+	snapshotMetadata  = []byte{0xDB, 0x1D, 0x0, 0x2}
+	// 后台周期性保存索引快照的时间间隔
+	snapshotInterval = 10 * time.Minute
+
+	errInvalidSnapshot = errors.New("invalid index snapshot")
+)
+
+type indexSnapshot struct {
+	lastCreated int64
+	regions     map[uint16]int64 // High-water mark of each region
+	entries     map[string]*INode
+}
+
+// saveIndexSnapshot 将所有索引分片写入快照文件，先写临时文件再原子替换
+func (lfs *LogStructuredFS) saveIndexSnapshot() error {
+	// 数据压缩会删除数据文件并释放 id，快照写入磁盘之前不能删除它引用的数据文件
+	lfs.compressor.mu.Lock()
+	defer lfs.compressor.mu.Unlock()
+
+	buf, err := lfs.marshalIndexSnapshot()
+	if err != nil {
+		return err
+	}
+	if buf, err = lfs.sealSnapshot(buf); err != nil {
+		return fmt.Errorf("failed to encrypt index snapshot: %w", err)
+	}
+
+	path := filepath.Join(lfs.path, indexSnapshotFile)
+	tmp := path + ".tmp"
+
+	file, err := lfs.fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, conf.FsPerm)
+	if err != nil {
+		return fmt.Errorf("failed to create index snapshot: %w", err)
+	}
+
+	_, err = file.WriteAt(buf, 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		lfs.fs.Remove(tmp)
+		return fmt.Errorf("failed to write index snapshot: %w", err)
+	}
+
+	if err := lfs.fs.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace index snapshot: %w", err)
+	}
+	if err := lfs.fs.SyncDir(lfs.path); err != nil {
+		return err
+	}
+
+	// 旧的快照已经被替换，只有新的快照引用的 id 不能重复使用
+	lfs.mu.Lock()
+	lfs.snapshotIDs = make(map[uint16]bool, len(lfs.regions)+1)
+	for id := range lfs.regions {
+		lfs.snapshotIDs[id] = true
+	}
+	lfs.snapshotIDs[lfs.regionID] = true
+	lfs.mu.Unlock()
+
+	return nil
+}
+
+// marshalIndexSnapshot 序列化索引快照。只在读锁内记录每个数据文件的高水位，索引分片在锁外逐个序列化，
+// 期间写入的记录位于高水位之后，恢复时按照时间戳重新回放。序列化之后同步活跃数据文件，
+// 保证快照引用的记录和高水位之前的数据都已经持久化。调用者需要持有 compressor.mu，
+// 快照期间不能删除索引引用的数据文件
+func (lfs *LogStructuredFS) marshalIndexSnapshot() ([]byte, error) {
+	lfs.mu.RLock()
+	buf, err := lfs.encodeSnapshotMarks()
+	lfs.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	buf = lfs.encodeSnapshotEntries(buf)
+
+	if _, err := lfs.syncActiveRegion(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// encodeIndexSnapshot 序列化数据文件的高水位和索引，调用者需要持有写锁，快照与索引完全一致
+func (lfs *LogStructuredFS) encodeIndexSnapshot() ([]byte, error) {
+	buf, err := lfs.encodeSnapshotMarks()
+	if err != nil {
+		return nil, err
+	}
+	return lfs.encodeSnapshotEntries(buf), nil
+}
+
+// encodeSnapshotMarks 序列化快照头部和每个数据文件的高水位，调用者需要持有读锁或者写锁
+func (lfs *LogStructuredFS) encodeSnapshotMarks() ([]byte, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, snapshotMetadata...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(lfs.lastCreated))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(lfs.regions)+1))
+
+	for id, file := range lfs.regions {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat region %d: %w", id, err)
+		}
+		buf = binary.BigEndian.AppendUint16(buf, id)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(info.Size()))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, lfs.regionID)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(lfs.offset))
+
+	return buf, nil
+}
+
+// encodeSnapshotEntries 逐个分片序列化索引并追加校验和，每次只持有一个分片的读锁
+func (lfs *LogStructuredFS) encodeSnapshotEntries(buf []byte) []byte {
+	countAt := len(buf)
+	buf = binary.BigEndian.AppendUint64(buf, 0)
+
+	var count uint64
+	lfs.rangeShards(func(index map[string]*INode) {
+		for key, inode := range index {
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+			buf = append(buf, key...)
+			buf = appendINode(buf, inode)
+			count++
+		}
+	})
+	binary.BigEndian.PutUint64(buf[countAt:], count)
+
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crc32Table))
+}
+
+func appendINode(buf []byte, inode *INode) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, inode.RegionID)
+	buf = binary.BigEndian.AppendUint32(buf, inode.Offset)
+	buf = binary.BigEndian.AppendUint32(buf, inode.Length)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(inode.CreatedTime.UnixNano()))
+	var expired int64
+	if !inode.EexpireTime.IsZero() {
+		expired = inode.EexpireTime.UnixNano()
+	}
+	return binary.BigEndian.AppendUint64(buf, uint64(expired))
+}
+
+func parseINode(buf []byte) *INode {
+	return &INode{
+		RegionID:    binary.BigEndian.Uint16(buf[0:2]),
+		Offset:      binary.BigEndian.Uint32(buf[2:6]),
+		Length:      binary.BigEndian.Uint32(buf[6:10]),
+		CreatedTime: time.Unix(0, int64(binary.BigEndian.Uint64(buf[10:18]))),
+		EexpireTime: unixTime(int64(binary.BigEndian.Uint64(buf[18:26]))),
+	}
+}
+
+// loadIndexSnapshot 读取、解密并校验索引快照文件，快照不存在时返回 nil
+func loadIndexSnapshot(fsys FileSystem, path string, kr *keyring) (*indexSnapshot, error) {
+	buf, err := readFile(fsys, filepath.Join(path, indexSnapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if buf, err = openSnapshot(kr, buf); err != nil {
+		return nil, err
+	}
+
+	return unmarshalIndexSnapshot(buf)
+}
+
+func unmarshalIndexSnapshot(buf []byte) (*indexSnapshot, error) {
+	headerSize := len(snapshotMetadata) + 8 + 2
+	if len(buf) < headerSize+8+4 {
+		return nil, errInvalidSnapshot
+	}
+
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crc32Table) != binary.BigEndian.Uint32(buf[len(body):]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errInvalidSnapshot)
+	}
+
+	for i := range snapshotMetadata {
+		if body[i] != snapshotMetadata[i] {
+			return nil, fmt.Errorf("%w: unsupported version", errInvalidSnapshot)
+		}
+	}
+
+	snap := &indexSnapshot{
+		lastCreated: int64(binary.BigEndian.Uint64(body[4:12])),
+		regions:     make(map[uint16]int64),
+		entries:     make(map[string]*INode),
+	}
+
+	regionCount := int(binary.BigEndian.Uint16(body[12:14]))
+	body = body[headerSize:]
+	if len(body) < regionCount*10+8 {
+		return nil, errInvalidSnapshot
+	}
+
+	for i := 0; i < regionCount; i++ {
+		id := binary.BigEndian.Uint16(body[0:2])
+		snap.regions[id] = int64(binary.BigEndian.Uint64(body[2:10]))
+		body = body[10:]
+	}
+
+	count := binary.BigEndian.Uint64(body[0:8])
+	body = body[8:]
+
+	for i := uint64(0); i < count; i++ {
+		if len(body) < 2 {
+			return nil, errInvalidSnapshot
+		}
+		size := int(binary.BigEndian.Uint16(body[0:2]))
+		if len(body) < 2+size+snapshotINodeSize {
+			return nil, errInvalidSnapshot
+		}
+		key := string(body[2 : 2+size])
+		snap.entries[key] = parseINode(body[2+size:])
+		body = body[2+size+snapshotINodeSize:]
+	}
+
+	if len(body) != 0 {
+		return nil, errInvalidSnapshot
+	}
+
+	return snap, nil
+}
+
+// restoreIndexSnapshot 加载索引快照到内存索引中，返回每个数据文件需要开始回放的偏移量。
+// 快照无效或者与数据文件不一致时返回 nil，调用者需要全量扫描
+func (lfs *LogStructuredFS) restoreIndexSnapshot(ids []uint16) map[uint16]int64 {
+	snap, err := loadIndexSnapshot(lfs.fs, lfs.path, lfs.keyring)
+	if err != nil {
+		clog.Warnf("Ignoring index snapshot of %s: %v", lfs.path, err)
+		return nil
+	}
+	if snap == nil {
+		return nil
+	}
+
+	// 即使快照被忽略，它依然留在磁盘上，引用的 id 在保存新的快照之前不能重复使用
+	for id := range snap.regions {
+		lfs.snapshotIDs[id] = true
+	}
+
+	exists := make(map[uint16]bool, len(ids))
+	for _, id := range ids {
+		exists[id] = true
+	}
+
+	// 快照引用的数据文件必须存在并且没有被截断
+	for id, size := range snap.regions {
+		if !exists[id] {
+			clog.Warnf("Ignoring index snapshot of %s: region %d is missing", lfs.path, id)
+			return nil
+		}
+		info, err := lfs.fs.Stat(filepath.Join(lfs.path, regionFileName(id)))
+		if err != nil || info.Size() < size {
+			clog.Warnf("Ignoring index snapshot of %s: region %d is truncated", lfs.path, id)
+			return nil
+		}
+	}
+
+	now := time.Now()
+	for key, inode := range snap.entries {
+		if !inode.EexpireTime.IsZero() && now.After(inode.EexpireTime) {
+			continue
+		}
+		lfs.AddINode(key, inode)
+	}
+
+	lfs.lastCreated = snap.lastCreated
+	clog.Infof("Loaded %d index entries from snapshot of %s", len(snap.entries), lfs.path)
+
+	return snap.regions
+}
@@ -0,0 +1,180 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestIndexSnapshot_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+	lfs.regionThreshold = 128
+
+	for i := 0; i < 8; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	buf, err := lfs.marshalIndexSnapshot()
+	if err != nil {
+		t.Fatalf("marshalIndexSnapshot() error: %v", err)
+	}
+
+	snap, err := unmarshalIndexSnapshot(buf)
+	if err != nil {
+		t.Fatalf("unmarshalIndexSnapshot() error: %v", err)
+	}
+
+	if snap.lastCreated != lfs.lastCreated || snap.regions[lfs.regionID] != lfs.offset {
+		t.Errorf("snapshot high-water mark = %v, want %d@%d", snap.regions, lfs.regionID, lfs.offset)
+	}
+
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		inode, _ := lfs.GetINode(key)
+		if !reflect.DeepEqual(snap.entries[key], inode) {
+			t.Errorf("snapshot entry = %+v, want %+v", snap.entries[key], inode)
+		}
+	}
+
+	buf[len(buf)/2] ^= 0xFF
+	if _, err := unmarshalIndexSnapshot(buf); err == nil {
+		t.Error("unmarshalIndexSnapshot() should reject corrupted snapshot")
+	}
+}
+
+func TestIndexSnapshot_Restore(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	for i := 0; i < 4; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("before"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+
+	if err := lfs.CloseFS(); err != nil {
+		t.Fatalf("CloseFS() error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, indexSnapshotFile)); err != nil {
+		t.Fatalf("index snapshot is missing: %v", err)
+	}
+
+	// 快照之后的写入需要通过回放高水位之后的记录恢复
+	lfs = openTestFS(t, dir)
+	for i := 2; i < 6; i++ {
+		err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("after"))
+		if err != nil {
+			t.Fatalf("PutSegment() error: %v", err)
+		}
+	}
+	crashTestFS(lfs)
+
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	for i := 0; i < 6; i++ {
+		seg, err := lfs.FetchSegment(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("FetchSegment(key-%d) error: %v", i, err)
+		}
+		want := "before"
+		if i >= 2 {
+			want = "after"
+		}
+		if string(seg.data) != want {
+			t.Errorf("FetchSegment(key-%d) = %s, want %s", i, seg.data, want)
+		}
+	}
+}
+
+func TestIndexSnapshot_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+
+	err := lfs.PutSegment("hello", newTestSegment("world"))
+	if err != nil {
+		t.Fatalf("PutSegment() error: %v", err)
+	}
+	lfs.CloseFS()
+
+	err = os.WriteFile(filepath.Join(dir, indexSnapshotFile), []byte("broken"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 快照损坏时回退到全量扫描
+	lfs = openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if _, err := lfs.FetchSegment("hello"); err != nil {
+		t.Errorf("FetchSegment() error: %v", err)
+	}
+}
+
+func TestIndexSnapshot_ConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(conf.Default)
+	opts.IndexShards = 16
+	opts.AdaptiveShards = false
+	lfs := openTestFSWith(t, dir, opts)
+
+	for i := 0; i < 10; i++ {
+		if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("before")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 序列化阻塞在一个分片上时，其他分片的写入不能被阻塞
+	blocked := lfs.lockShard("key-0")
+	other := "other"
+	for i := 0; lfs.index.Load().shard(HashSum64(other)) == blocked; i++ {
+		other = fmt.Sprintf("other-%d", i)
+	}
+
+	saved := make(chan error, 1)
+	go func() { saved <- lfs.saveIndexSnapshot() }()
+	time.Sleep(50 * time.Millisecond)
+
+	written := make(chan error, 1)
+	go func() { written <- lfs.PutSegment(other, newTestSegment("during")) }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PutSegment() is blocked by the index snapshot")
+	}
+
+	blocked.mux.Unlock()
+	if err := <-saved; err != nil {
+		t.Fatalf("saveIndexSnapshot() error: %v", err)
+	}
+	if err := lfs.PutSegment("key-1", newTestSegment("after")); err != nil {
+		t.Fatal(err)
+	}
+	crashTestFS(lfs)
+
+	lfs = openTestFSWith(t, dir, opts)
+	defer lfs.CloseFS()
+
+	want := map[string]string{"key-0": "before", "key-1": "after", other: "during"}
+	for key, value := range want {
+		seg, err := lfs.FetchSegment(key)
+		if err != nil || string(seg.data) != value {
+			t.Errorf("FetchSegment(%s) = %v, %v, want %s", key, seg, err, value)
+		}
+	}
+}
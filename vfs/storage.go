@@ -0,0 +1,24 @@
+package vfs
+
+import "time"
+
+// Storage is the segment store used by the server, implemented by
+// LogStructuredFS on disk and MemoryStorage in memory.
+type Storage interface {
+	PutSegment(key string, seg *Segment) error
+	FetchSegment(key string) (*Segment, error)
+	DeleteSegment(key string) error
+	BatchINodes(wb *WriteBatch) error
+	TTL(key string) (time.Duration, error)
+	ExpireSegment(key string, ttl time.Duration) error
+	PersistSegment(key string) error
+	Keys() []string
+	Iterator(start, end string) *Iterator
+	Prefix(prefix string) *Iterator
+	CloseFS() error
+}
+
+var (
+	_ Storage = (*LogStructuredFS)(nil)
+	_ Storage = (*MemoryStorage)(nil)
+)
@@ -0,0 +1,80 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testStorages 返回需要保持相同语义的全部 Storage 实现
+func testStorages(t *testing.T) map[string]Storage {
+	t.Helper()
+
+	lfs := openTestFS(t, t.TempDir())
+	t.Cleanup(func() { lfs.CloseFS() })
+
+	return map[string]Storage{
+		"lfs":    lfs,
+		"memory": newTestMemoryStorage(t, nil),
+	}
+}
+
+func TestStorage_DeleteExpired(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		expired := newTestSegment("value")
+		expired.SetTTL(time.Millisecond)
+		if err := storage.PutSegment("expired", expired); err != nil {
+			t.Fatalf("%s: PutSegment() error: %v", name, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if err := storage.DeleteSegment("expired"); !errors.Is(err, ErrSegmentNotFound) {
+			t.Errorf("%s: DeleteSegment(expired) = %v, want %v", name, err, ErrSegmentNotFound)
+		}
+		if err := storage.DeleteSegment("missing"); !errors.Is(err, ErrSegmentNotFound) {
+			t.Errorf("%s: DeleteSegment(missing) = %v, want %v", name, err, ErrSegmentNotFound)
+		}
+
+		if err := storage.PutSegment("alive", newTestSegment("value")); err != nil {
+			t.Fatalf("%s: PutSegment() error: %v", name, err)
+		}
+		if err := storage.DeleteSegment("alive"); err != nil {
+			t.Errorf("%s: DeleteSegment(alive) error: %v", name, err)
+		}
+		if _, err := storage.FetchSegment("alive"); !errors.Is(err, ErrSegmentNotFound) {
+			t.Errorf("%s: FetchSegment(alive) after delete = %v, want %v", name, err, ErrSegmentNotFound)
+		}
+	}
+}
+
+func TestStorage_CallerSegmentUnchanged(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		seg := newTestSegment("value")
+		if err := storage.PutSegment("put", seg); err != nil {
+			t.Fatalf("%s: PutSegment() error: %v", name, err)
+		}
+		if seg.key != "" || seg.createdAt != 0 {
+			t.Errorf("%s: PutSegment() changed caller segment to key %q created at %d", name, seg.key, seg.createdAt)
+		}
+
+		batched := newTestSegment("value")
+		wb := NewWriteBatch()
+		wb.Put("batch", batched)
+		if err := storage.BatchINodes(wb); err != nil {
+			t.Fatalf("%s: BatchINodes() error: %v", name, err)
+		}
+		if batched.key != "" || batched.createdAt != 0 {
+			t.Errorf("%s: BatchINodes() changed caller segment to key %q created at %d", name, batched.key, batched.createdAt)
+		}
+
+		// 同一个 Segment 可以存入多个 key
+		if err := storage.PutSegment("other", seg); err != nil {
+			t.Fatalf("%s: PutSegment() error: %v", name, err)
+		}
+		for _, key := range []string{"put", "batch", "other"} {
+			if got, err := storage.FetchSegment(key); err != nil || string(got.data) != "value" {
+				t.Errorf("%s: FetchSegment(%s) = %v, %v", name, key, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/auula/vasedb/conf"
+)
+
+// groupCommit 合并并发写入的 fsync，同一时刻只有一个写入者执行 fsync，
+// 其他写入者等待它完成，fsync 期间追加的记录由下一轮 fsync 一起持久化。
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  int64 // Timestamp of the latest record known to be durable
+	syncing bool
+}
+
+func newGroupCommit() *groupCommit {
+	gc := new(groupCommit)
+	gc.cond = sync.NewCond(&gc.mu)
+	return gc
+}
+
+// commitSync 在 SyncAlways 模式下等待当前已经追加的记录持久化，调用者不能持有锁
+func (lfs *LogStructuredFS) commitSync() error {
+	if lfs.syncMode != conf.SyncAlways {
+		return nil
+	}
+
+	lfs.mu.RLock()
+	target := lfs.lastCreated
+	lfs.mu.RUnlock()
+
+	gc := lfs.committer
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for gc.synced < target {
+		if gc.syncing {
+			gc.cond.Wait()
+			continue
+		}
+
+		gc.syncing = true
+		gc.mu.Unlock()
+		synced, err := lfs.syncActiveRegion()
+		gc.mu.Lock()
+		gc.syncing = false
+		gc.cond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+		if synced > gc.synced {
+			gc.synced = synced
+		}
+	}
+
+	return nil
+}
+
+// syncActiveRegion 持久化活跃数据文件，返回已经持久化的最新记录的时间戳。
+// 已经封存的数据文件在滚动时已经 fsync 过了，所以只需要处理活跃数据文件
+func (lfs *LogStructuredFS) syncActiveRegion() (int64, error) {
+	lfs.mu.RLock()
+	file, synced := lfs.activeRegion, lfs.lastCreated
+	lfs.mu.RUnlock()
+
+	// fsync 期间不持有锁，文件可能已经滚动并且被压缩关闭，此时数据已经持久化
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return 0, fmt.Errorf("failed to sync active region: %w", err)
+	}
+
+	return synced, nil
+}
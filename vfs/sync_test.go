@@ -0,0 +1,36 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/auula/vasedb/conf"
+)
+
+func TestGroupCommit_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	lfs := openTestFS(t, dir)
+	defer lfs.CloseFS()
+
+	if lfs.syncMode != conf.SyncAlways {
+		t.Fatalf("syncMode = %v, want %v", lfs.syncMode, conf.SyncAlways)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := lfs.PutSegment(fmt.Sprintf("key-%d", i), newTestSegment("value")); err != nil {
+				t.Errorf("PutSegment() error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 所有写入返回之后，最新的记录必须已经持久化
+	if lfs.committer.synced != lfs.lastCreated {
+		t.Errorf("synced = %d, want %d", lfs.committer.synced, lfs.lastCreated)
+	}
+}
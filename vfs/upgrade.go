@@ -0,0 +1,54 @@
+package vfs
+
+import (
+	"fmt"
+
+	"github.com/auula/vasedb/clog"
+	"github.com/auula/vasedb/conf"
+)
+
+// UpgradeStat is the result of Upgrade.
+type UpgradeStat struct {
+	Regions int    `json:"regions"` // Number of regions rewritten in the current format
+	Format  string `json:"format"`  // Current file format version
+}
+
+// Upgrade rewrites every region of the data directory at path which is written in an older file
+// format. The directory must not be in use. A running server upgrades old regions in the
+// background through compaction instead, Upgrade finishes the migration at once.
+func Upgrade(path string, opts *Options) (*UpgradeStat, error) {
+	if opts == nil {
+		opts = NewOptions(conf.Default)
+	}
+
+	// 升级期间不运行后台任务，由 Compressor.Upgrade 重写全部旧格式的数据文件
+	o := *opts
+	o.Compaction = false
+	o.Scrub = false
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("invalid file system options: %w", err)
+	}
+
+	if _, err := o.FileSystem.Stat(path); err != nil {
+		return nil, fmt.Errorf("data directory is not available: %w", err)
+	}
+
+	// 打开时旧格式的活跃数据文件被封存，新的记录写入当前格式的数据文件
+	lfs, err := OpenFS(path, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &UpgradeStat{Format: currentFormat.String()}
+	stat.Regions, err = lfs.compressor.Upgrade()
+	if cerr := lfs.CloseFS(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clog.Infof("Upgraded %d regions of %s to format %s", stat.Regions, path, stat.Format)
+
+	return stat, nil
+}